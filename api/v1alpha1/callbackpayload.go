@@ -20,7 +20,9 @@ along with r-gespraech.  If not, see <http://www.gnu.org/licenses/>.
 package v1alpha1
 
 import (
+	"k8s.io/apimachinery/pkg/api/equality"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 )
 
 // Set status condition helper
@@ -35,3 +37,39 @@ func (p *CallbackPayload) SetCondition(conditionType string, status metav1.Condi
 		})
 	*/
 }
+
+// FindDelivery returns the delivery of the payload to the callback with the UID, or nil.
+func (p *CallbackPayload) FindDelivery(callbackUID types.UID) *CallbackPayloadDelivery {
+	for i := range p.Status.Deliveries {
+		if p.Status.Deliveries[i].CallbackUID == callbackUID {
+			return &p.Status.Deliveries[i]
+		}
+	}
+
+	return nil
+}
+
+// SetDelivery adds or replaces the delivery of the payload to a callback, it returns true if the delivery changed.
+// The LastTransitionTime is set if the phase changed.
+func (p *CallbackPayload) SetDelivery(delivery CallbackPayloadDelivery) bool {
+	existing := p.FindDelivery(delivery.CallbackUID)
+	if existing == nil {
+		if delivery.LastTransitionTime.IsZero() {
+			delivery.LastTransitionTime = metav1.Now()
+		}
+		p.Status.Deliveries = append(p.Status.Deliveries, delivery)
+		return true
+	}
+
+	delivery.LastTransitionTime = existing.LastTransitionTime
+	if existing.Phase != delivery.Phase || delivery.LastTransitionTime.IsZero() {
+		delivery.LastTransitionTime = metav1.Now()
+	}
+	// the deliveries hold pointers, e.g. the RetryAfter
+	if equality.Semantic.DeepEqual(*existing, delivery) {
+		return false
+	}
+	*existing = delivery
+
+	return true
+}
@@ -22,12 +22,17 @@ package v1alpha1
 import (
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 )
 
 // CallbackPayloadSpec defines the desired state of CallbackPayload
 type CallbackPayloadSpec struct {
 	Data     string               `json:"data"`
 	Selector metav1.LabelSelector `json:"selector"`
+	// Priority of the delivery, CallbackPayloads with a higher priority are delivered first if a CallbackUrl limits
+	// its maxActiveDeliveries. It defaults to 0, the priority of a waiting CallbackPayload grows with its age.
+	//+optional
+	Priority int32 `json:"priority,omitempty"`
 }
 
 // These are built-in conditions of a CallbackPayload.
@@ -38,6 +43,8 @@ const (
 	CallbackPayloadComplete string = "Complete"
 	// CallbackPayloadFailed means the payload has failed sending.
 	CallbackPayloadFailed string = "Failed"
+	// CallbackPayloadDeduplicated means the payload has not been sent, as a payload with the same content has been.
+	CallbackPayloadDeduplicated string = "Deduplicated"
 )
 
 // CallbackPayloadCondition describes current state of a payload.
@@ -60,17 +67,66 @@ type CallbackPayloadCondition struct {
 	Message string `json:"message,omitempty"`
 }
 
+// CallbackPayloadDelivery is the state of the delivery of a CallbackPayload to one CallbackUrl or ClusterCallbackUrl.
+type CallbackPayloadDelivery struct {
+	// Callback is the namespace/name of the CallbackUrl, or the name of the ClusterCallbackUrl.
+	Callback string `json:"callback"`
+	// CallbackUID is the UID of the CallbackUrl or ClusterCallbackUrl.
+	CallbackUID types.UID `json:"callbackUID"`
+	// Phase is the phase of the delivery, Sending, Complete, Failed or Deduplicated.
+	Phase string `json:"phase"`
+	// Job is the name of the sender Job of the latest delivery attempt.
+	//+optional
+	Job string `json:"job,omitempty"`
+	// ObservedGeneration is the generation of the CallbackPayload delivered by the latest delivery attempt.
+	//+optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// RetryAfter is the time the receiver asked to retry the delivery after, with a 429 or 503 response.
+	//+optional
+	RetryAfter *metav1.Time `json:"retryAfter,omitempty"`
+	// DeliveryID is the ID of the delivery sent in its idempotency key header, the same for every attempt of it.
+	//+optional
+	DeliveryID string `json:"deliveryID,omitempty"`
+	// ContentHash is the content hash of the request rendered by the latest delivery attempt.
+	//+optional
+	ContentHash string `json:"contentHash,omitempty"`
+	// DuplicateOf is the namespace/name of the CallbackPayload delivered with the same content, if Deduplicated.
+	//+optional
+	DuplicateOf string `json:"duplicateOf,omitempty"`
+	// HTTPStatus is the HTTP status code the receiver responded with.
+	//+optional
+	HTTPStatus int32 `json:"httpStatus,omitempty"`
+	// ErrorClass classifies a failed delivery, e.g. ConnectionRefused, Timeout, ClientError or ServerError.
+	//+optional
+	ErrorClass string `json:"errorClass,omitempty"`
+	// Response is the beginning of the receiver's response.
+	//+optional
+	Response string `json:"response,omitempty"`
+	// Reason is the reason the sender container terminated with, e.g. Completed, Error or OOMKilled.
+	//+optional
+	Reason string `json:"reason,omitempty"`
+	// LastTransitionTime is the last time the phase changed.
+	//+optional
+	LastTransitionTime metav1.Time `json:"lastTransitionTime,omitempty"`
+}
+
 // CallbackPayloadStatus defines the observed state of CallbackPayload
 type CallbackPayloadStatus struct {
 	// Conditions is the list of error conditions for this resource
 	//+operator-sdk:csv:customresourcedefinitions:type=status,displayName="Conditions",xDescriptors={"urn:alm:descriptor:io.kubernetes.conditions"}
 	//+optional
 	Conditions []metav1.Condition `json:"conditions,omitempty" patchStrategy:"merge" patchMergeKey:"type"`
+
+	// Deliveries is the state of the delivery to each CallbackUrl or ClusterCallbackUrl selecting the payload.
+	//+listType=map
+	//+listMapKey=callbackUID
+	//+optional
+	Deliveries []CallbackPayloadDelivery `json:"deliveries,omitempty"`
 }
 
 //+kubebuilder:object:root=true
 //+kubebuilder:subresource:status
-//+kubebuilder:resource:scope=Cluster
+//+kubebuilder:resource:scope=Namespaced
 
 // CallbackPayload is storing the actual Payload Data we want to send back to any Callback URL. The
 // web services receiving the Payload are determined via metav1.LabelSelector `selector`.
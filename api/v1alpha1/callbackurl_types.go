@@ -20,6 +20,9 @@ along with r-gespraech.  If not, see <http://www.gnu.org/licenses/>.
 package v1alpha1
 
 import (
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -28,19 +31,227 @@ const (
 	PhaseAwaitingPayloads string = "AwaitingPayloads"
 	PhasePending          string = "Pending"
 	PhaseOk               string = "Ready"
+	PhaseSuspended        string = "Suspended"
+	PhaseUnreachable      string = "Unreachable"
+	PhaseVerifying        string = "Verifying"
 )
 
 // CallbackUrl Condition Types
 const (
 	AssociatedPayloads   string = "AssociatedPayloads"
 	NoAssociatedPayloads string = "NoAssociatedPayloads"
+	// ServiceAvailable tells if the Service referenced by `serviceRef` and its endpoints exist.
+	ServiceAvailable string = "ServiceAvailable"
+	// EgressAllowed tells if the callback target is allowed by the EgressPolicy.
+	EgressAllowed string = "EgressAllowed"
+	// CrossNamespaceAllowed tells if the `namespaceSelector` is allowed by the ErinnerungConfig.
+	CrossNamespaceAllowed string = "CrossNamespaceAllowed"
+	// Reachable tells if the callback target responded to the latest probe.
+	Reachable string = "Reachable"
+	// Verified tells if the receiver echoed the challenge of the latest verification.
+	Verified string = "Verified"
+	// Suspended tells if the deliveries are suspended, by the `suspend` field or as the receiver responded 410 Gone.
+	Suspended string = "Suspended"
+)
+
+// OnUpdate policies of a CallbackUrl, telling what happens if the data of a delivered CallbackPayload changes
+const (
+	// OnUpdateIgnore does not deliver the changed data.
+	OnUpdateIgnore string = "ignore"
+	// OnUpdateRedeliver delivers the changed data again.
+	OnUpdateRedeliver string = "redeliver"
+	// OnUpdateDeliverPatch delivers a JSON merge patch (RFC 7386) from the delivered to the changed data, or the
+	// changed data if either of them is not a JSON object.
+	OnUpdateDeliverPatch string = "deliverPatch"
+)
+
+// Ordering modes of a CallbackUrl, telling in which order the CallbackPayloads of a correlation key are delivered
+const (
+	// OrderingNone delivers the CallbackPayloads concurrently, in no particular order.
+	OrderingNone string = "none"
+	// OrderingCreation delivers the CallbackPayloads one after the other, in the order they have been created.
+	OrderingCreation string = "creation"
+	// OrderingSequence delivers the CallbackPayloads one after the other, in the order of their SequenceAnnotation.
+	OrderingSequence string = "sequence"
+)
+
+// SequenceAnnotation is the sequence number of a CallbackPayload, an integer ordering its delivery if the CallbackUrl
+// has the ordering "sequence".
+const SequenceAnnotation string = "erinnerung.thoth-station.ninja/sequence"
+
+// Request headers identifying a delivery to the receiver
+const (
+	// DefaultIdempotencyKeyHeader carries the ID of the delivery, a retry has the same ID as the first attempt.
+	DefaultIdempotencyKeyHeader string = "Idempotency-Key"
+	// AttemptHeader carries the number of the attempt of the delivery, starting at 1 for every delivery ID.
+	AttemptHeader string = "Erinnerung-Attempt"
+)
+
+// CancelDeliveriesFinalizer is the finalizer of CallbackUrls, ClusterCallbackUrls and CallbackPayloads, cancelling
+// their pending and active deliveries once they are deleted.
+const CancelDeliveriesFinalizer string = "erinnerung.thoth-station.ninja/cancel-deliveries"
+
+// Labels and annotations set on the sender Jobs to correlate them with the CallbackPayloads they deliver
+const (
+	// PayloadUIDLabel is the UID of the CallbackPayload delivered by the sender Job.
+	PayloadUIDLabel string = "erinnerung.thoth-station.ninja/payload-uid"
+	// CallbackUIDLabel is the UID of the CallbackUrl or ClusterCallbackUrl the sender Job delivers to.
+	CallbackUIDLabel string = "erinnerung.thoth-station.ninja/callback-uid"
+	// CallbackNameLabel is the name of the CallbackUrl or ClusterCallbackUrl, truncated to a valid label value.
+	CallbackNameLabel string = "erinnerung.thoth-station.ninja/callback-name"
+	// PayloadNameLabel is the name of the CallbackPayload, truncated to a valid label value.
+	PayloadNameLabel string = "erinnerung.thoth-station.ninja/payload-name"
+	// AttemptLabel is the delivery attempt of the sender Job, starting at 0.
+	AttemptLabel string = "erinnerung.thoth-station.ninja/attempt"
+	// DeliveryIDAnnotation is the ID of the logical delivery of the sender Job, shared by all its attempts.
+	DeliveryIDAnnotation string = "erinnerung.thoth-station.ninja/delivery-id"
+	// DeliveryAttemptAnnotation is the attempt of the logical delivery of the sender Job, starting at 1.
+	DeliveryAttemptAnnotation string = "erinnerung.thoth-station.ninja/delivery-attempt"
+	// BackPressureAnnotation is the time the receiver asked the sender Job to retry after, with a 429 or 503 response.
+	BackPressureAnnotation string = "erinnerung.thoth-station.ninja/back-pressure"
+	// ContentHashAnnotation is the content hash of the request rendered by the sender Job.
+	ContentHashAnnotation string = "erinnerung.thoth-station.ninja/content-hash"
+	// PayloadGenerationAnnotation is the generation of the CallbackPayload delivered by the sender Job.
+	PayloadGenerationAnnotation string = "erinnerung.thoth-station.ninja/payload-generation"
+	// CallbackAnnotation is the namespace/name (or name) of the CallbackUrl or ClusterCallbackUrl.
+	CallbackAnnotation string = "erinnerung.thoth-station.ninja/callback"
+	// PayloadAnnotation is the namespace/name of the CallbackPayload delivered by the sender Job.
+	PayloadAnnotation string = "erinnerung.thoth-station.ninja/payload"
+	// CorrelationKeyAnnotation is the correlation key whose CallbackPayload label is copied to the sender Job.
+	CorrelationKeyAnnotation string = "erinnerung.thoth-station.ninja/correlation-key"
 )
 
 // CallbackUrlSpec defines the desired state of CallbackUrl
 type CallbackUrlSpec struct {
-	// Url is the Url to call back.
-	URL      string               `json:"url"`
-	Selector metav1.LabelSelector `json:"selector"`
+	// Url is the Url to call back. Either `url` or `serviceRef` must be set.
+	//+optional
+	URL string `json:"url,omitempty"`
+	// ServiceRef is a reference to an in-cluster Service to call back, it is resolved to an URL at send time.
+	//+optional
+	ServiceRef *ServiceReference    `json:"serviceRef,omitempty"`
+	Selector   metav1.LabelSelector `json:"selector"`
+	// NamespaceSelector selects the namespaces CallbackPayloads are matched in, if omitted only the CallbackUrl's
+	// namespace is used. It requires cross-namespace matching to be enabled in the ErinnerungConfig, and only the
+	// namespaces allowed by its rules are used.
+	//+optional
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+	// CorrelationKey is the key of a CallbackPayload label copied to its sender Jobs, e.g.
+	// "adviser.thoth-station.ninja/adviser-id". It defaults to the correlationKey of the ErinnerungConfig.
+	//+optional
+	CorrelationKey string `json:"correlationKey,omitempty"`
+	// IdempotencyKeyHeader is the name of the request header carrying the ID of the delivery, which is the same for
+	// every attempt of it. It defaults to the idempotencyKeyHeader of the ErinnerungConfig, or "Idempotency-Key".
+	//+kubebuilder:validation:Pattern=`^[A-Za-z0-9-]+$`
+	//+optional
+	IdempotencyKeyHeader string `json:"idempotencyKeyHeader,omitempty"`
+	// Probe enables the periodic probing of the callback target, its result is reported by the Reachable condition.
+	//+optional
+	Probe *ProbeSpec `json:"probe,omitempty"`
+	// Verification requires the receiver to prove it agreed to receive callbacks: the operator sends it a challenge,
+	// which it must echo. Nothing is delivered until the CallbackUrl is verified, it is verified again periodically.
+	//+optional
+	Verification *VerificationSpec `json:"verification,omitempty"`
+	// Suspend stops all deliveries of the CallbackUrl, its CallbackPayloads are kept and delivered once it is resumed.
+	// It is set by the operator if the receiver responds 410 Gone, or fails its verification for longer than the
+	// verification's suspendAfter.
+	//+optional
+	Suspend bool `json:"suspend,omitempty"`
+	// OnUpdate tells what happens if the data of a delivered CallbackPayload changes: "ignore" it, "redeliver" the
+	// data, or "deliverPatch" a JSON merge patch to the receiver. It defaults to "ignore", relabeling a
+	// CallbackPayload never causes a delivery.
+	//+kubebuilder:validation:Enum=ignore;redeliver;deliverPatch
+	//+optional
+	OnUpdate string `json:"onUpdate,omitempty"`
+	// Ordering tells in which order the CallbackPayloads with the same correlation key value are delivered: "none"
+	// (the default) delivers them concurrently, "creation" and "sequence" deliver them strictly one after the other, in
+	// the order of their creation or of their "erinnerung.thoth-station.ninja/sequence" annotation. A CallbackPayload
+	// is not delivered while an earlier one is being delivered or retried.
+	//+kubebuilder:validation:Enum=none;creation;sequence
+	//+optional
+	Ordering string `json:"ordering,omitempty"`
+	// MaxActiveDeliveries is the maximum number of sender Jobs of the CallbackUrl running concurrently, the waiting
+	// CallbackPayloads are delivered by priority. If omitted, all CallbackPayloads are delivered at once.
+	//+kubebuilder:validation:Minimum=1
+	//+optional
+	MaxActiveDeliveries int32 `json:"maxActiveDeliveries,omitempty"`
+	// MaxAttempts is the number of attempts delivering a CallbackPayload, a failed delivery is attempted again until
+	// it is reached. It defaults to 1. The receiver's back-pressure responses, 429 and 503, are not counted up to a
+	// cap, the next attempt is sent no earlier than their Retry-After.
+	//+kubebuilder:validation:Minimum=1
+	//+optional
+	MaxAttempts int32 `json:"maxAttempts,omitempty"`
+	// DeliverExisting tells which CallbackPayloads existing before the activation of the CallbackUrl are delivered:
+	// "all" (the default), "none", or those created "since(<RFC 3339 time>)". The CallbackUrl is activated again once
+	// its selector or namespaceSelector is edited.
+	//+kubebuilder:validation:Pattern=`^(all|none|since\(.+\))$`
+	//+optional
+	DeliverExisting string `json:"deliverExisting,omitempty"`
+	// DeduplicationWindow enables the deduplication of CallbackPayloads: a CallbackPayload is not delivered if one
+	// with the same rendered request has been delivered successfully within the window, e.g. "1h". It is marked with
+	// a Deduplicated condition instead.
+	//+optional
+	DeduplicationWindow *metav1.Duration `json:"deduplicationWindow,omitempty"`
+	// SenderTemplate is a partial pod template customizing the sender Jobs, merged strategically over the
+	// senderTemplate of the ErinnerungConfig. A CallbackUrl may only set the image and resources of the sender
+	// container, named "curl-sender", the node selector and the tolerations; a ClusterCallbackUrl may set any field.
+	// The command, env and the restart policy of the sender container are set by the operator.
+	//+kubebuilder:validation:Schemaless
+	//+kubebuilder:validation:Type=object
+	//+kubebuilder:pruning:PreserveUnknownFields
+	//+optional
+	SenderTemplate *corev1.PodTemplateSpec `json:"senderTemplate,omitempty"`
+}
+
+// ServiceReference references a Kubernetes Service to be used as the callback target.
+type ServiceReference struct {
+	// Name is the name of the Service.
+	Name string `json:"name"`
+	// Namespace is the namespace of the Service, it defaults to the namespace of the CallbackUrl. A CallbackUrl may
+	// only reference a Service of its own namespace.
+	//+optional
+	Namespace string `json:"namespace,omitempty"`
+	// Port is the port of the Service to call back.
+	//+kubebuilder:validation:Minimum=1
+	//+kubebuilder:validation:Maximum=65535
+	Port int32 `json:"port"`
+	// Path is the URL path to call back, it defaults to "/".
+	//+optional
+	Path string `json:"path,omitempty"`
+	// Scheme is the URL scheme, either "http" or "https". It defaults to "http".
+	//+kubebuilder:validation:Enum=http;https
+	//+optional
+	Scheme string `json:"scheme,omitempty"`
+}
+
+// ProbeSpec configures the periodic probing of a callback target.
+type ProbeSpec struct {
+	// Method is the HTTP method of the probe, it defaults to "HEAD".
+	//+kubebuilder:validation:Enum=HEAD;OPTIONS;GET
+	//+optional
+	Method string `json:"method,omitempty"`
+	// Path is the URL path probed instead of the one of the callback target, e.g. a health endpoint.
+	//+kubebuilder:validation:Pattern=`^/`
+	//+optional
+	Path string `json:"path,omitempty"`
+	// Interval is the time between probes, it defaults to 5m.
+	//+optional
+	Interval *metav1.Duration `json:"interval,omitempty"`
+	// Timeout is the time a probe waits for the response, it defaults to 5s and may be at most 30s.
+	//+optional
+	Timeout *metav1.Duration `json:"timeout,omitempty"`
+}
+
+// MaxProbeTimeout is the maximum timeout of a probe.
+const MaxProbeTimeout = 30 * time.Second
+
+// VerificationSpec configures the verification of a receiver.
+type VerificationSpec struct {
+	// Interval is the time between verifications of a verified receiver, it defaults to 24h.
+	//+optional
+	Interval *metav1.Duration `json:"interval,omitempty"`
+	// SuspendAfter suspends the CallbackUrl once the verification has been failing for longer, if set.
+	//+optional
+	SuspendAfter *metav1.Duration `json:"suspendAfter,omitempty"`
 }
 
 // CallbackUrlStatus defines the observed state of CallbackUrl
@@ -54,11 +265,38 @@ type CallbackUrlStatus struct {
 	//+operator-sdk:csv:customresourcedefinitions:type=status,displayName="Conditions",xDescriptors={"urn:alm:descriptor:io.kubernetes.conditions"}
 	//+optional
 	Conditions []metav1.Condition `json:"conditions,omitempty" patchStrategy:"merge" patchMergeKey:"type"`
+
+	// ActivationTime is the activation watermark of the CallbackUrl: the time it was created, or its selector or
+	// namespaceSelector was last edited. It is applied by the deliverExisting policy "none".
+	//+optional
+	ActivationTime *metav1.Time `json:"activationTime,omitempty"`
+	// ActivatedSelector is the selector and namespaceSelector the CallbackUrl was activated with.
+	//+optional
+	ActivatedSelector string `json:"activatedSelector,omitempty"`
+	// LastProbeTime is the time the callback target was last probed.
+	//+optional
+	LastProbeTime *metav1.Time `json:"lastProbeTime,omitempty"`
+	// ProbeLatency is the time the callback target took to respond to the latest probe.
+	//+optional
+	ProbeLatency *metav1.Duration `json:"probeLatency,omitempty"`
+	// LastVerificationTime is the time the receiver was last sent a challenge.
+	//+optional
+	LastVerificationTime *metav1.Time `json:"lastVerificationTime,omitempty"`
+	// VerifiedTime is the time the receiver last echoed the challenge.
+	//+optional
+	VerifiedTime *metav1.Time `json:"verifiedTime,omitempty"`
+	// VerifiedTarget is the URL of the receiver the Verified condition applies to, a changed target is verified again.
+	//+optional
+	VerifiedTarget string `json:"verifiedTarget,omitempty"`
+	// PausedUntil is the time the receiver asked to retry after, with a 429 or 503 response. No delivery is sent
+	// before.
+	//+optional
+	PausedUntil *metav1.Time `json:"pausedUntil,omitempty"`
 }
 
 //+kubebuilder:object:root=true
 //+kubebuilder:subresource:status
-//+kubebuilder:resource:scope=Cluster
+//+kubebuilder:resource:scope=Namespaced
 
 // CallbackUrl is a web service's URL to receive a Callback. The Callback Payload to be send to the
 // web service is determined via the metav1.LabelSelector `selector`.
@@ -81,21 +319,56 @@ type CallbackUrlList struct {
 
 // Aggregate phase from conditions
 func (u *CallbackUrl) AggregatePhase() string {
-	if len(u.Status.Conditions) == 0 {
+	return u.Status.AggregatePhase()
+}
+
+// Aggregate phase from conditions
+func (s *CallbackUrlStatus) AggregatePhase() string {
+	if len(s.Conditions) == 0 {
 		return PhasePending
 	}
 
-	for _, c := range u.Status.Conditions {
+	var suspended, verifying, unreachable, awaiting bool
+	for _, c := range s.Conditions {
 		switch c.Type {
-		case NoAssociatedPayloads:
-			if c.Status == metav1.ConditionTrue {
-				return PhaseAwaitingPayloads
+		case ServiceAvailable, EgressAllowed, CrossNamespaceAllowed:
+			if c.Status == metav1.ConditionFalse {
+				return PhaseFailed
 			}
+		case NoAssociatedPayloads:
+			awaiting = c.Status == metav1.ConditionTrue
+		case Reachable:
+			unreachable = c.Status == metav1.ConditionFalse
+		case Verified:
+			verifying = c.Status != metav1.ConditionTrue
+		case Suspended:
+			suspended = c.Status == metav1.ConditionTrue
 		}
 	}
+
+	switch {
+	case suspended:
+		return PhaseSuspended
+	case verifying:
+		return PhaseVerifying
+	case unreachable:
+		return PhaseUnreachable
+	case awaiting:
+		return PhaseAwaitingPayloads
+	}
 	return PhaseOk
 }
 
+// CallbackSpec returns the spec of the CallbackUrl.
+func (u *CallbackUrl) CallbackSpec() *CallbackUrlSpec {
+	return &u.Spec
+}
+
+// CallbackStatus returns the status of the CallbackUrl.
+func (u *CallbackUrl) CallbackStatus() *CallbackUrlStatus {
+	return &u.Status
+}
+
 func init() {
 	SchemeBuilder.Register(&CallbackUrl{}, &CallbackUrlList{})
 }
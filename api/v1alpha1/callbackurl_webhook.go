@@ -20,11 +20,16 @@ along with r-gespraech.  If not, see <http://www.gnu.org/licenses/>.
 package v1alpha1
 
 import (
+	"fmt"
 	"net/url"
+	"strings"
 
+	"k8s.io/apimachinery/pkg/api/equality"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation"
 	"k8s.io/apimachinery/pkg/util/validation/field"
 	ctrl "sigs.k8s.io/controller-runtime"
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
@@ -34,6 +39,17 @@ import (
 // log is for logging in this package.
 var callbackurllog = logf.Log.WithName("callbackurl-resource")
 
+// webhookConfig is the ErinnerungConfig enforced by the validating webhook.
+var webhookConfig = &ErinnerungConfig{}
+
+// SetWebhookConfig sets the ErinnerungConfig enforced by the validating webhook.
+func SetWebhookConfig(cfg *ErinnerungConfig) {
+	if cfg == nil {
+		cfg = &ErinnerungConfig{}
+	}
+	webhookConfig = cfg
+}
+
 func (r *CallbackUrl) SetupWebhookWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewWebhookManagedBy(mgr).
 		For(r).
@@ -42,6 +58,16 @@ func (r *CallbackUrl) SetupWebhookWithManager(mgr ctrl.Manager) error {
 
 // TODO(user): EDIT THIS FILE!  THIS IS SCAFFOLDING FOR YOU TO OWN!
 
+// validateServiceNamespace validates the `serviceRef` of a CallbackUrl references a Service of its own namespace. An
+// in-cluster Service is not subject to the EgressPolicy, so a tenant must not reach the Services of other namespaces.
+func validateServiceNamespace(spec *CallbackUrlSpec, namespace string) *field.Error {
+	if spec.ServiceRef == nil || spec.ServiceRef.Namespace == "" || spec.ServiceRef.Namespace == namespace {
+		return nil
+	}
+
+	return field.Forbidden(field.NewPath("spec").Child("serviceRef").Child("namespace"), "a CallbackUrl may only reference a Service of its own namespace")
+}
+
 // TODO(user): change verbs to "verbs=create;update;delete" if you want to enable deletion validation.
 //+kubebuilder:webhook:path=/validate-erinnerung-thoth-station-ninja-v1alpha1-callbackurl,mutating=false,failurePolicy=fail,sideEffects=None,groups=erinnerung.thoth-station.ninja,resources=callbackurls,verbs=create;update,versions=v1alpha1,name=vcallbackurl.kb.io,admissionReviewVersions=v1
 
@@ -58,6 +84,12 @@ func (r *CallbackUrl) ValidateCreate() error {
 func (r *CallbackUrl) ValidateUpdate(old runtime.Object) error {
 	callbackurllog.Info("validate update", "name", r.Name)
 
+	// a CallbackUrl being deleted, or an update of its metadata only, e.g. of its finalizers, is not validated again:
+	// it may no longer pass after the ErinnerungConfig changed
+	if !r.DeletionTimestamp.IsZero() || equality.Semantic.DeepEqual(r.Spec, old.(*CallbackUrl).Spec) {
+		return nil
+	}
+
 	return r.validateCallbackUrl()
 }
 
@@ -69,7 +101,25 @@ func (r *CallbackUrl) ValidateDelete() error {
 func (r *CallbackUrl) validateCallbackUrl() error {
 	var allErrs field.ErrorList
 
-	if err := r.validateCallbackUrlSpec(); err != nil {
+	if err := validateCallbackTarget(&r.Spec); err != nil {
+		allErrs = append(allErrs, err)
+	}
+	if err := validateServiceNamespace(&r.Spec, r.Namespace); err != nil {
+		allErrs = append(allErrs, err)
+	}
+	if err := validateNamespaceSelector(&r.Spec, true); err != nil {
+		allErrs = append(allErrs, err)
+	}
+	if err := validateCorrelationKey(&r.Spec); err != nil {
+		allErrs = append(allErrs, err)
+	}
+	if err := validateDeliverExisting(&r.Spec); err != nil {
+		allErrs = append(allErrs, err)
+	}
+	if err := validateSenderTemplate(&r.Spec); err != nil {
+		allErrs = append(allErrs, err)
+	}
+	if err := validateProbe(&r.Spec); err != nil {
 		allErrs = append(allErrs, err)
 	}
 
@@ -82,9 +132,111 @@ func (r *CallbackUrl) validateCallbackUrl() error {
 		r.Name, allErrs)
 }
 
-func (r *CallbackUrl) validateCallbackUrlSpec() *field.Error {
-	if _, err := url.Parse(r.Spec.URL); err != nil {
-		return field.Invalid(field.NewPath("spec").Child("url"), r.Spec.URL, err.Error())
+// validateCallbackTarget validates the `url` or `serviceRef` of a CallbackUrl or ClusterCallbackUrl.
+func validateCallbackTarget(spec *CallbackUrlSpec) *field.Error {
+	specPath := field.NewPath("spec")
+
+	switch {
+	case spec.URL == "" && spec.ServiceRef == nil:
+		return field.Required(specPath.Child("url"), "either url or serviceRef must be set")
+	case spec.URL != "" && spec.ServiceRef != nil:
+		return field.Forbidden(specPath.Child("serviceRef"), "url and serviceRef are mutually exclusive")
+	case spec.ServiceRef != nil:
+		return validateServiceReference(specPath.Child("serviceRef"), spec.ServiceRef)
+	}
+
+	u, err := url.Parse(spec.URL)
+	if err != nil {
+		return field.Invalid(specPath.Child("url"), spec.URL, err.Error())
+	}
+	host, port, err := URLHostPort(u)
+	if err != nil {
+		return field.Invalid(specPath.Child("url"), spec.URL, err.Error())
+	}
+	// the address the host resolves to is checked again at send time
+	if err := webhookConfig.EgressPolicy.ValidateHostPort(host, port); err != nil {
+		return field.Forbidden(specPath.Child("url"), err.Error())
+	}
+
+	return nil
+}
+
+// validateNamespaceSelector validates the `namespaceSelector`, if gated it requires cross-namespace matching to be
+// enabled in the ErinnerungConfig. The namespaces can not be listed if the operator is restricted to namespaces.
+func validateNamespaceSelector(spec *CallbackUrlSpec, gated bool) *field.Error {
+	if spec.NamespaceSelector == nil {
+		return nil
+	}
+
+	path := field.NewPath("spec").Child("namespaceSelector")
+	if webhookConfig.Namespaced() {
+		return field.Forbidden(path, "the operator is restricted to namespaces")
+	}
+	if gated && (webhookConfig.CrossNamespace == nil || !webhookConfig.CrossNamespace.Enabled) {
+		return field.Forbidden(path, "cross-namespace matching is not enabled")
+	}
+	if _, err := metav1.LabelSelectorAsSelector(spec.NamespaceSelector); err != nil {
+		return field.Invalid(path, spec.NamespaceSelector, err.Error())
+	}
+
+	return nil
+}
+
+// validateSenderTemplate validates the `senderTemplate` of a CallbackUrl only sets the fields a namespace tenant may
+// customize, see RestrictSenderTemplate.
+func validateSenderTemplate(spec *CallbackUrlSpec) *field.Error {
+	if spec.SenderTemplate == nil || equality.Semantic.DeepEqual(RestrictSenderTemplate(spec.SenderTemplate), spec.SenderTemplate) {
+		return nil
+	}
+
+	return field.Forbidden(field.NewPath("spec").Child("senderTemplate"),
+		fmt.Sprintf("only the image and resources of the %q container, the nodeSelector and tolerations may be set", SenderContainerName))
+}
+
+// validateProbe validates the timeout of the `probe` does not exceed MaxProbeTimeout.
+func validateProbe(spec *CallbackUrlSpec) *field.Error {
+	if spec.Probe == nil || spec.Probe.Timeout == nil || spec.Probe.Timeout.Duration <= MaxProbeTimeout {
+		return nil
+	}
+
+	return field.Invalid(field.NewPath("spec").Child("probe").Child("timeout"), spec.Probe.Timeout.Duration.String(),
+		fmt.Sprintf("must be at most %s", MaxProbeTimeout))
+}
+
+// validateCorrelationKey validates the `correlationKey` is a label key.
+func validateCorrelationKey(spec *CallbackUrlSpec) *field.Error {
+	if spec.CorrelationKey == "" {
+		return nil
+	}
+	if errs := validation.IsQualifiedName(spec.CorrelationKey); len(errs) > 0 {
+		return field.Invalid(field.NewPath("spec").Child("correlationKey"), spec.CorrelationKey, strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+// validateDeliverExisting validates the `deliverExisting` policy.
+func validateDeliverExisting(spec *CallbackUrlSpec) *field.Error {
+	if _, err := ParseDeliverExisting(spec.DeliverExisting); err != nil {
+		return field.Invalid(field.NewPath("spec").Child("deliverExisting"), spec.DeliverExisting, err.Error())
+	}
+
+	return nil
+}
+
+func validateServiceReference(path *field.Path, ref *ServiceReference) *field.Error {
+	if ref.Name == "" {
+		return field.Required(path.Child("name"), "the name of the Service must be set")
+	}
+	if ref.Port < 1 || ref.Port > 65535 {
+		return field.Invalid(path.Child("port"), ref.Port, "must be between 1 and 65535")
+	}
+	if ref.Path != "" && !strings.HasPrefix(ref.Path, "/") {
+		return field.Invalid(path.Child("path"), ref.Path, "must start with a '/'")
+	}
+	// in-cluster Services are not subject to the network restrictions, but to the port restrictions
+	if err := webhookConfig.EgressPolicy.ValidatePort(int(ref.Port)); err != nil {
+		return field.Forbidden(path.Child("port"), err.Error())
 	}
 
 	return nil
@@ -0,0 +1,198 @@
+/*
+Copyright (C) 2022 Christoph Görn
+
+This file is part of r-gespraech.
+
+r-gespraech is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+r-gespraech is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with r-gespraech.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package v1alpha1
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var _ = Describe("CallbackUrl webhook", func() {
+	Context("When validating the callback target", func() {
+		It("Should accept an url", func() {
+			u := &CallbackUrl{Spec: CallbackUrlSpec{URL: "https://example.com/callback"}}
+			Expect(u.ValidateCreate()).To(Succeed())
+		})
+
+		It("Should accept a serviceRef", func() {
+			u := &CallbackUrl{Spec: CallbackUrlSpec{ServiceRef: &ServiceReference{Name: "receiver", Port: 8080, Path: "/callback"}}}
+			Expect(u.ValidateCreate()).To(Succeed())
+		})
+
+		It("Should reject a CallbackUrl without url and serviceRef", func() {
+			u := &CallbackUrl{}
+			Expect(u.ValidateCreate()).NotTo(Succeed())
+		})
+
+		It("Should reject a CallbackUrl with url and serviceRef", func() {
+			u := &CallbackUrl{Spec: CallbackUrlSpec{
+				URL:        "https://example.com/callback",
+				ServiceRef: &ServiceReference{Name: "receiver", Port: 8080},
+			}}
+			Expect(u.ValidateCreate()).NotTo(Succeed())
+		})
+
+		It("Should reject a serviceRef with a relative path", func() {
+			u := &CallbackUrl{Spec: CallbackUrlSpec{ServiceRef: &ServiceReference{Name: "receiver", Port: 8080, Path: "callback"}}}
+			Expect(u.ValidateCreate()).NotTo(Succeed())
+		})
+
+		It("Should reject a serviceRef to another namespace", func() {
+			u := &CallbackUrl{
+				ObjectMeta: metav1.ObjectMeta{Name: "abc123", Namespace: "tenant"},
+				Spec:       CallbackUrlSpec{ServiceRef: &ServiceReference{Name: "receiver", Namespace: "tenant", Port: 8080}},
+			}
+			Expect(u.ValidateCreate()).To(Succeed())
+
+			u.Spec.ServiceRef.Namespace = "kube-system"
+			Expect(u.ValidateCreate()).NotTo(Succeed())
+		})
+
+		It("Should reject an invalid deliverExisting policy", func() {
+			u := &CallbackUrl{Spec: CallbackUrlSpec{URL: "https://example.com/callback", DeliverExisting: "since(yesterday)"}}
+			Expect(u.ValidateCreate()).NotTo(Succeed())
+
+			u.Spec.DeliverExisting = "since(2022-06-01T00:00:00Z)"
+			Expect(u.ValidateCreate()).To(Succeed())
+		})
+
+		It("Should reject a correlationKey that is not a label key", func() {
+			u := &CallbackUrl{Spec: CallbackUrlSpec{URL: "https://example.com/callback", CorrelationKey: "not a label/key/"}}
+			Expect(u.ValidateCreate()).NotTo(Succeed())
+
+			u.Spec.CorrelationKey = "adviser.thoth-station.ninja/adviser-id"
+			Expect(u.ValidateCreate()).To(Succeed())
+		})
+
+		It("Should reject a probe timeout above the maximum", func() {
+			u := &CallbackUrl{Spec: CallbackUrlSpec{URL: "https://example.com/callback", Probe: &ProbeSpec{
+				Timeout: &metav1.Duration{Duration: MaxProbeTimeout},
+			}}}
+			Expect(u.ValidateCreate()).To(Succeed())
+
+			u.Spec.Probe.Timeout.Duration = 2 * MaxProbeTimeout
+			Expect(u.ValidateCreate()).NotTo(Succeed())
+		})
+	})
+
+	Context("When validating the senderTemplate", func() {
+		It("Should only allow the image, resources, nodeSelector and tolerations", func() {
+			u := &CallbackUrl{Spec: CallbackUrlSpec{
+				URL: "https://example.com/callback",
+				SenderTemplate: &corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+					NodeSelector: map[string]string{"node-pool": "egress"},
+					Containers:   []corev1.Container{{Name: SenderContainerName, Image: "example.com/sender"}},
+				}},
+			}}
+			Expect(u.ValidateCreate()).To(Succeed())
+
+			u.Spec.SenderTemplate.Spec.ServiceAccountName = "cluster-admin"
+			Expect(u.ValidateCreate()).NotTo(Succeed())
+
+			u.Spec.SenderTemplate.Spec.ServiceAccountName = ""
+			u.Spec.SenderTemplate.Spec.Volumes = []corev1.Volume{{Name: "host", VolumeSource: corev1.VolumeSource{HostPath: &corev1.HostPathVolumeSource{Path: "/"}}}}
+			Expect(u.ValidateCreate()).NotTo(Succeed())
+		})
+	})
+
+	Context("When validating the callback target against the EgressPolicy", func() {
+		AfterEach(func() {
+			SetWebhookConfig(nil)
+		})
+
+		It("Should reject the cloud metadata endpoint", func() {
+			u := &CallbackUrl{Spec: CallbackUrlSpec{URL: "http://169.254.169.254/latest/meta-data/"}}
+			Expect(u.ValidateCreate()).NotTo(Succeed())
+		})
+
+		It("Should reject a host that is not allowed", func() {
+			SetWebhookConfig(&ErinnerungConfig{EgressPolicy: &EgressPolicy{AllowedHosts: []string{"*.example.com"}}})
+
+			u := &CallbackUrl{Spec: CallbackUrlSpec{URL: "https://example.org/callback"}}
+			Expect(u.ValidateCreate()).NotTo(Succeed())
+
+			u = &CallbackUrl{Spec: CallbackUrlSpec{URL: "https://hooks.example.com/callback"}}
+			Expect(u.ValidateCreate()).To(Succeed())
+		})
+
+		It("Should reject a port that is not allowed", func() {
+			SetWebhookConfig(&ErinnerungConfig{EgressPolicy: &EgressPolicy{AllowedPorts: []int32{443}}})
+
+			u := &CallbackUrl{Spec: CallbackUrlSpec{URL: "http://example.com:8080/callback"}}
+			Expect(u.ValidateCreate()).NotTo(Succeed())
+
+			u = &CallbackUrl{Spec: CallbackUrlSpec{ServiceRef: &ServiceReference{Name: "receiver", Port: 8080}}}
+			Expect(u.ValidateCreate()).NotTo(Succeed())
+		})
+	})
+	Context("When validating the namespaceSelector", func() {
+		AfterEach(func() {
+			SetWebhookConfig(nil)
+		})
+
+		It("Should reject a namespaceSelector if cross-namespace matching is disabled", func() {
+			u := &CallbackUrl{Spec: CallbackUrlSpec{
+				URL:               "https://example.com/callback",
+				NamespaceSelector: &metav1.LabelSelector{},
+			}}
+			Expect(u.ValidateCreate()).NotTo(Succeed())
+
+			SetWebhookConfig(&ErinnerungConfig{CrossNamespace: &CrossNamespacePolicy{Enabled: true}})
+			Expect(u.ValidateCreate()).To(Succeed())
+		})
+
+		It("Should reject a namespaceSelector if the operator is restricted to namespaces", func() {
+			u := &CallbackUrl{Spec: CallbackUrlSpec{
+				URL:               "https://example.com/callback",
+				NamespaceSelector: &metav1.LabelSelector{},
+			}}
+			SetWebhookConfig(&ErinnerungConfig{Namespaces: []string{"default"}, CrossNamespace: &CrossNamespacePolicy{Enabled: true}})
+			Expect(u.ValidateCreate()).NotTo(Succeed())
+
+			c := &ClusterCallbackUrl{Spec: CallbackUrlSpec{URL: "https://example.com/callback"}}
+			Expect(c.ValidateCreate()).NotTo(Succeed())
+			Expect(c.ValidateUpdate(c)).To(Succeed())
+		})
+
+		It("Should let the finalizer of an object no longer passing the validation be removed", func() {
+			u := &CallbackUrl{Spec: CallbackUrlSpec{
+				URL:               "https://example.com/callback",
+				NamespaceSelector: &metav1.LabelSelector{},
+			}}
+			c := &ClusterCallbackUrl{Spec: u.Spec}
+			SetWebhookConfig(&ErinnerungConfig{Namespaces: []string{"default"}})
+
+			By("By updating its metadata only")
+			Expect(u.ValidateUpdate(u.DeepCopy())).To(Succeed())
+			Expect(c.ValidateUpdate(c.DeepCopy())).To(Succeed())
+
+			By("By updating it while it is being deleted")
+			changed := u.DeepCopy()
+			changed.Spec.URL = "https://example.com/other"
+			Expect(changed.ValidateUpdate(u)).NotTo(Succeed())
+			changed.DeletionTimestamp = &metav1.Time{Time: time.Now()}
+			Expect(changed.ValidateUpdate(u)).To(Succeed())
+		})
+	})
+})
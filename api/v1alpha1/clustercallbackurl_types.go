@@ -0,0 +1,82 @@
+/*
+Copyright (C) 2022 Christoph Görn
+
+This file is part of r-gespraech.
+
+r-gespraech is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+r-gespraech is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with r-gespraech.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Callback is implemented by CallbackUrl and ClusterCallbackUrl, so both are handled by the same delivery machinery.
+// +kubebuilder:object:generate=false
+type Callback interface {
+	client.Object
+
+	CallbackSpec() *CallbackUrlSpec
+	CallbackStatus() *CallbackUrlStatus
+	AggregatePhase() string
+}
+
+var (
+	_ Callback = &CallbackUrl{}
+	_ Callback = &ClusterCallbackUrl{}
+)
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:resource:scope=Cluster
+
+// ClusterCallbackUrl is a web service's URL to receive Callbacks from all namespaces. The namespaces are determined
+// via the metav1.LabelSelector `namespaceSelector`, if omitted CallbackPayloads of all namespaces are matched.
+type ClusterCallbackUrl struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   CallbackUrlSpec   `json:"spec,omitempty"`
+	Status CallbackUrlStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// ClusterCallbackUrlList contains a list of ClusterCallbackUrl
+type ClusterCallbackUrlList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ClusterCallbackUrl `json:"items"`
+}
+
+// Aggregate phase from conditions
+func (u *ClusterCallbackUrl) AggregatePhase() string {
+	return u.Status.AggregatePhase()
+}
+
+// CallbackSpec returns the spec of the ClusterCallbackUrl.
+func (u *ClusterCallbackUrl) CallbackSpec() *CallbackUrlSpec {
+	return &u.Spec
+}
+
+// CallbackStatus returns the status of the ClusterCallbackUrl.
+func (u *ClusterCallbackUrl) CallbackStatus() *CallbackUrlStatus {
+	return &u.Status
+}
+
+func init() {
+	SchemeBuilder.Register(&ClusterCallbackUrl{}, &ClusterCallbackUrlList{})
+}
@@ -0,0 +1,110 @@
+/*
+Copyright (C) 2022 Christoph Görn
+
+This file is part of r-gespraech.
+
+r-gespraech is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+r-gespraech is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with r-gespraech.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package v1alpha1
+
+import (
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+)
+
+// log is for logging in this package.
+var clustercallbackurllog = logf.Log.WithName("clustercallbackurl-resource")
+
+func (r *ClusterCallbackUrl) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(r).
+		Complete()
+}
+
+//+kubebuilder:webhook:path=/validate-erinnerung-thoth-station-ninja-v1alpha1-clustercallbackurl,mutating=false,failurePolicy=fail,sideEffects=None,groups=erinnerung.thoth-station.ninja,resources=clustercallbackurls,verbs=create;update,versions=v1alpha1,name=vclustercallbackurl.kb.io,admissionReviewVersions=v1
+
+var _ webhook.Validator = &ClusterCallbackUrl{}
+
+// ValidateCreate implements webhook.Validator so a webhook will be registered for the type
+func (r *ClusterCallbackUrl) ValidateCreate() error {
+	clustercallbackurllog.Info("validate create", "name", r.Name)
+
+	// existing ClusterCallbackUrls may still have their finalizer removed, see ValidateUpdate
+	if webhookConfig.Namespaced() {
+		return apierrors.NewForbidden(GroupVersion.WithResource("clustercallbackurls").GroupResource(), r.Name,
+			fmt.Errorf("ClusterCallbackUrls are not reconciled while the operator is restricted to namespaces"))
+	}
+
+	return r.validateClusterCallbackUrl()
+}
+
+// ValidateUpdate implements webhook.Validator so a webhook will be registered for the type
+func (r *ClusterCallbackUrl) ValidateUpdate(old runtime.Object) error {
+	clustercallbackurllog.Info("validate update", "name", r.Name)
+
+	// a ClusterCallbackUrl being deleted, or an update of its metadata only, e.g. of its finalizers, is not validated
+	// again: it may no longer pass after the ErinnerungConfig changed
+	if !r.DeletionTimestamp.IsZero() || equality.Semantic.DeepEqual(r.Spec, old.(*ClusterCallbackUrl).Spec) {
+		return nil
+	}
+
+	return r.validateClusterCallbackUrl()
+}
+
+// ValidateDelete implements webhook.Validator so a webhook will be registered for the type
+func (r *ClusterCallbackUrl) ValidateDelete() error {
+	return nil
+}
+
+func (r *ClusterCallbackUrl) validateClusterCallbackUrl() error {
+	var allErrs field.ErrorList
+
+	if err := validateCallbackTarget(&r.Spec); err != nil {
+		allErrs = append(allErrs, err)
+	}
+	// there is no namespace to default to
+	if r.Spec.ServiceRef != nil && r.Spec.ServiceRef.Namespace == "" {
+		allErrs = append(allErrs, field.Required(field.NewPath("spec").Child("serviceRef").Child("namespace"), "the namespace of the Service must be set"))
+	}
+	// only cluster admins may create a ClusterCallbackUrl, so it is not subject to the CrossNamespacePolicy
+	if err := validateNamespaceSelector(&r.Spec, false); err != nil {
+		allErrs = append(allErrs, err)
+	}
+	if err := validateCorrelationKey(&r.Spec); err != nil {
+		allErrs = append(allErrs, err)
+	}
+	if err := validateDeliverExisting(&r.Spec); err != nil {
+		allErrs = append(allErrs, err)
+	}
+	if err := validateProbe(&r.Spec); err != nil {
+		allErrs = append(allErrs, err)
+	}
+
+	if len(allErrs) == 0 {
+		return nil
+	}
+
+	return apierrors.NewInvalid(
+		schema.GroupKind{Group: ErinnerungGroupName, Kind: "ClusterCallbackUrl"},
+		r.Name, allErrs)
+}
@@ -0,0 +1,79 @@
+/*
+Copyright (C) 2022 Christoph Görn
+
+This file is part of r-gespraech.
+
+r-gespraech is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+r-gespraech is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with r-gespraech.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package v1alpha1
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// DeliverExisting policies of a CallbackUrl, telling which of the CallbackPayloads existing before its activation are
+// delivered
+const (
+	// DeliverExistingAll delivers all CallbackPayloads.
+	DeliverExistingAll string = "all"
+	// DeliverExistingNone delivers the CallbackPayloads created after the activation only.
+	DeliverExistingNone string = "none"
+)
+
+// DeliverExistingPolicy is a parsed `deliverExisting` of a CallbackUrl.
+// +kubebuilder:object:generate=false
+type DeliverExistingPolicy struct {
+	// None is set for "none", the CallbackPayloads created before the activation are not delivered.
+	None bool
+	// Since is set for "since(<time>)", the CallbackPayloads created before it are not delivered.
+	Since *time.Time
+}
+
+// ParseDeliverExisting parses a `deliverExisting` of a CallbackUrl: "all" (or empty), "none" or "since(<time>)" with
+// an RFC 3339 time.
+func ParseDeliverExisting(value string) (DeliverExistingPolicy, error) {
+	switch value {
+	case "", DeliverExistingAll:
+		return DeliverExistingPolicy{}, nil
+	case DeliverExistingNone:
+		return DeliverExistingPolicy{None: true}, nil
+	}
+
+	if strings.HasPrefix(value, "since(") && strings.HasSuffix(value, ")") {
+		since, err := time.Parse(time.RFC3339, strings.TrimSuffix(strings.TrimPrefix(value, "since("), ")"))
+		if err != nil {
+			return DeliverExistingPolicy{}, fmt.Errorf("invalid time: %v", err)
+		}
+		return DeliverExistingPolicy{Since: &since}, nil
+	}
+
+	return DeliverExistingPolicy{}, fmt.Errorf("must be all, none or since(<RFC 3339 time>)")
+}
+
+// Delivers tells if a CallbackPayload created at creationTime is delivered by a CallbackUrl activated at activation.
+func (p DeliverExistingPolicy) Delivers(creationTime metav1.Time, activation *metav1.Time) bool {
+	switch {
+	case p.None:
+		return activation == nil || !creationTime.Before(activation)
+	case p.Since != nil:
+		return !creationTime.Time.Before(*p.Since)
+	}
+
+	return true
+}
@@ -0,0 +1,60 @@
+/*
+Copyright (C) 2022 Christoph Görn
+
+This file is part of r-gespraech.
+
+r-gespraech is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+r-gespraech is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with r-gespraech.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package v1alpha1
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var _ = Describe("DeliverExisting policy", func() {
+	activation := metav1.NewTime(time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC))
+	before := metav1.NewTime(activation.Add(-time.Hour))
+	after := metav1.NewTime(activation.Add(time.Hour))
+
+	It("Should deliver all CallbackPayloads by default", func() {
+		policy, err := ParseDeliverExisting("")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(policy.Delivers(before, &activation)).To(BeTrue())
+	})
+
+	It("Should deliver the CallbackPayloads created after the activation only", func() {
+		policy, err := ParseDeliverExisting(DeliverExistingNone)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(policy.Delivers(before, &activation)).To(BeFalse())
+		Expect(policy.Delivers(activation, &activation)).To(BeTrue())
+		Expect(policy.Delivers(after, &activation)).To(BeTrue())
+	})
+
+	It("Should deliver the CallbackPayloads created since a time", func() {
+		policy, err := ParseDeliverExisting("since(2022-06-01T11:30:00Z)")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(policy.Delivers(before, &activation)).To(BeFalse())
+		Expect(policy.Delivers(activation, &activation)).To(BeTrue())
+	})
+
+	It("Should reject an unknown policy", func() {
+		_, err := ParseDeliverExisting("some")
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,169 @@
+/*
+Copyright (C) 2022 Christoph Görn
+
+This file is part of r-gespraech.
+
+r-gespraech is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+r-gespraech is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with r-gespraech.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package v1alpha1
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// DefaultDeniedCIDRs are the networks denied if an EgressPolicy does not set DeniedCIDRs: loopback, link-local
+// (including cloud metadata endpoints) and private networks.
+var DefaultDeniedCIDRs = []string{
+	"0.0.0.0/8",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"100.64.0.0/10",
+	"::/128",
+	"::1/128",
+	"fe80::/10",
+	"fc00::/7",
+}
+
+// URLHostPort returns the host and the port of an URL, the port defaults to the scheme's default port.
+func URLHostPort(u *url.URL) (string, int, error) {
+	host := u.Hostname()
+	if host == "" {
+		return "", 0, fmt.Errorf("the URL has no host")
+	}
+
+	if p := u.Port(); p != "" {
+		port, err := strconv.Atoi(p)
+		if err != nil {
+			return "", 0, fmt.Errorf("the URL has an invalid port: %w", err)
+		}
+		return host, port, nil
+	}
+
+	switch u.Scheme {
+	case "http":
+		return host, 80, nil
+	case "https":
+		return host, 443, nil
+	}
+
+	return "", 0, fmt.Errorf("the URL scheme %q is not supported", u.Scheme)
+}
+
+// ValidateHostPort checks host and port against the host and port restrictions, if host is an IP address it is
+// checked against the network restrictions too. A nil EgressPolicy applies the defaults.
+func (p *EgressPolicy) ValidateHostPort(host string, port int) error {
+	if err := p.ValidatePort(port); err != nil {
+		return err
+	}
+
+	if p != nil && len(p.AllowedHosts) > 0 {
+		allowed := false
+		for _, h := range p.AllowedHosts {
+			if matchHost(h, host) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("the host %s is not in the list of allowed hosts", host)
+		}
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		return p.ValidateIP(ip)
+	}
+	if strings.EqualFold(strings.TrimSuffix(host, "."), "localhost") {
+		return p.ValidateIP(net.IPv4(127, 0, 0, 1))
+	}
+
+	return nil
+}
+
+// ValidatePort checks port against the port restrictions.
+func (p *EgressPolicy) ValidatePort(port int) error {
+	if p == nil || len(p.AllowedPorts) == 0 {
+		return nil
+	}
+
+	for _, allowed := range p.AllowedPorts {
+		if int(allowed) == port {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("the port %d is not in the list of allowed ports", port)
+}
+
+// ValidateIP checks an (already resolved) IP address against the network restrictions.
+func (p *EgressPolicy) ValidateIP(ip net.IP) error {
+	denied := DefaultDeniedCIDRs
+	var allowed []string
+	if p != nil {
+		if p.DeniedCIDRs != nil {
+			denied = p.DeniedCIDRs
+		}
+		allowed = p.AllowedCIDRs
+	}
+
+	in, err := containsIP(allowed, ip)
+	if err != nil {
+		return err
+	}
+	if in {
+		return nil
+	}
+
+	in, err = containsIP(denied, ip)
+	if err != nil {
+		return err
+	}
+	if in {
+		return fmt.Errorf("the address %s is in a denied network", ip)
+	}
+
+	return nil
+}
+
+func containsIP(cidrs []string, ip net.IP) (bool, error) {
+	for _, c := range cidrs {
+		_, network, err := net.ParseCIDR(c)
+		if err != nil {
+			return false, fmt.Errorf("invalid CIDR %q in EgressPolicy: %w", c, err)
+		}
+		if network.Contains(ip) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func matchHost(pattern, host string) bool {
+	pattern = strings.ToLower(strings.TrimSuffix(pattern, "."))
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:])
+	}
+
+	return pattern == host
+}
@@ -20,6 +20,7 @@
 package v1alpha1
 
 import (
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	cfg "sigs.k8s.io/controller-runtime/pkg/config/v1alpha1"
 )
@@ -35,12 +36,161 @@ type ErinnerungConfig struct {
 	// ControllerManagerConfigurationSpec returns the contfigurations for controllers
 	cfg.ControllerManagerConfigurationSpec `json:",inline"`
 
-	// Namespaces is the list of Namespaces we want to operate in
-	// TODO this might be an anti-pattern, if the operator is namespace-scoped, do we need to deploy it to each namespace we want to operate in?!
+	// Namespaces is the list of Namespaces we want to operate in, if omitted we operate in all namespaces. The
+	// manager-role must be bound by a RoleBinding in each of the namespaces instead of a ClusterRoleBinding, so the
+	// cluster-scoped ClusterCallbackUrls and the `namespaceSelector` of CallbackUrls are not supported.
 	Namespaces []string `json:"namespaces,omitempty"`
+
+	// OwnNamespace restricts the operator to the namespace it is running in, which is read from the POD_NAMESPACE
+	// environment variable. It can not be combined with Namespaces.
+	OwnNamespace bool `json:"ownNamespace,omitempty"`
+
+	// EgressPolicy restricts the targets callbacks may be sent to, if omitted the defaults of EgressPolicy apply.
+	EgressPolicy *EgressPolicy `json:"egressPolicy,omitempty"`
+
+	// CorrelationKey is the key of a CallbackPayload label copied to its sender Jobs, unless the CallbackUrl sets its
+	// own correlationKey.
+	//+optional
+	CorrelationKey string `json:"correlationKey,omitempty"`
+
+	// IdempotencyKeyHeader is the name of the request header carrying the ID of the delivery, unless the CallbackUrl
+	// sets its own idempotencyKeyHeader. It defaults to "Idempotency-Key".
+	//+optional
+	IdempotencyKeyHeader string `json:"idempotencyKeyHeader,omitempty"`
+
+	// SenderTemplate is a partial pod template customizing the sender Jobs, e.g. their image, resources, service
+	// account, node selector or tolerations. It is merged strategically over the operator's defaults, the sender container is
+	// customized by naming it "curl-sender". Its command, env and the restart policy are set by the operator.
+	//+kubebuilder:validation:Schemaless
+	//+kubebuilder:validation:Type=object
+	//+kubebuilder:pruning:PreserveUnknownFields
+	//+optional
+	SenderTemplate *corev1.PodTemplateSpec `json:"senderTemplate,omitempty"`
+
+	// SenderNetworkPolicies enables a NetworkPolicy per CallbackUrl (and ClusterCallbackUrl), limiting the egress of
+	// its sender Jobs to the address and port of the callback target.
+	//+optional
+	SenderNetworkPolicies bool `json:"senderNetworkPolicies,omitempty"`
+
+	// MaxConcurrentReconciles is the maximum number of CallbackUrls (and ClusterCallbackUrls) reconciled concurrently,
+	// it defaults to 1.
+	//+kubebuilder:validation:Minimum=1
+	MaxConcurrentReconciles int `json:"maxConcurrentReconciles,omitempty"`
+
+	// PriorityAging is the time a waiting CallbackPayload takes to gain a priority of 1, so CallbackPayloads with a
+	// low priority are not starved by higher ones. It defaults to 1m.
+	//+optional
+	PriorityAging *metav1.Duration `json:"priorityAging,omitempty"`
+
+	// Signing signs the deliveries with the private keys of a Secret, the public keys are served as JWKS. If omitted,
+	// the deliveries are not signed.
+	//+optional
+	Signing *SigningConfig `json:"signing,omitempty"`
+
+	// CrossNamespace controls if CallbackUrls may receive CallbackPayloads from other namespaces, if omitted they may not.
+	CrossNamespace *CrossNamespacePolicy `json:"crossNamespace,omitempty"`
 }
 
-//+kubebuilder:object:root=true
+// SigningConfig configures the signatures of the deliveries.
+type SigningConfig struct {
+	// SecretName is the name of the Secret holding the private keys, PEM encoded PKCS #8 Ed25519 or RSA keys by their
+	// key ID. The key signing the deliveries is named by the SigningKeyAnnotation of the Secret, all keys are
+	// published so keys can be rolled over.
+	SecretName string `json:"secretName"`
+
+	// SecretNamespace is the namespace of the Secret, it defaults to the namespace the operator is running in.
+	//+optional
+	SecretNamespace string `json:"secretNamespace,omitempty"`
+
+	// Format is the format of the signature headers, a detached JWS ("jws", the default) or HTTP Message Signatures
+	// ("httpMessageSignatures", RFC 9421).
+	//+kubebuilder:validation:Enum=jws;httpMessageSignatures
+	//+optional
+	Format string `json:"format,omitempty"`
+
+	// JWKSBindAddress is the address the JWKS endpoint serving the public keys binds to, it defaults to ":8082".
+	//+optional
+	JWKSBindAddress string `json:"jwksBindAddress,omitempty"`
+}
+
+// Signature formats of the deliveries
+const (
+	// SigningFormatJWS sends a detached JWS (RFC 7515) of the request body in the JWSSignatureHeader.
+	SigningFormatJWS string = "jws"
+	// SigningFormatHTTPMessageSignatures sends the Signature-Input, Signature and Content-Digest headers of HTTP
+	// Message Signatures (RFC 9421).
+	SigningFormatHTTPMessageSignatures string = "httpMessageSignatures"
+
+	// SigningKeyAnnotation is the ID of the key signing the deliveries, annotated on the Secret holding the keys.
+	SigningKeyAnnotation string = "erinnerung.thoth-station.ninja/signing-key"
+	// JWSSignatureHeader carries the detached JWS of the request body.
+	JWSSignatureHeader string = "Erinnerung-Signature"
+)
+
+// CrossNamespacePolicy controls the use of CallbackUrl's `namespaceSelector`.
+type CrossNamespacePolicy struct {
+	// Enabled allows CallbackUrls to set a `namespaceSelector`.
+	Enabled bool `json:"enabled,omitempty"`
+
+	// Rules is the allowlist of namespaces which may feed CallbackUrls in other namespaces.
+	Rules []CrossNamespaceRule `json:"rules,omitempty"`
+}
+
+// CrossNamespaceRule allows the CallbackUrls of a namespace to receive CallbackPayloads from a list of namespaces.
+type CrossNamespaceRule struct {
+	// CallbackUrlNamespace is the namespace of the CallbackUrls this rule applies to.
+	CallbackUrlNamespace string `json:"callbackUrlNamespace"`
+
+	// PayloadNamespaces is the list of namespaces the CallbackUrls may receive CallbackPayloads from, "*" allows all
+	// namespaces.
+	PayloadNamespaces []string `json:"payloadNamespaces"`
+}
+
+// EgressPolicy restricts the hosts, networks and ports the operator will send callbacks to.
+type EgressPolicy struct {
+	// DeniedCIDRs is the list of networks callbacks must not be sent to. If omitted, link-local, loopback and
+	// private networks are denied.
+	DeniedCIDRs []string `json:"deniedCIDRs,omitempty"`
+
+	// AllowedCIDRs is the list of networks exempted from DeniedCIDRs.
+	AllowedCIDRs []string `json:"allowedCIDRs,omitempty"`
+
+	// AllowedHosts is the list of host names callbacks may be sent to, an entry starting with "*." matches all
+	// subdomains. If omitted, all hosts are allowed.
+	AllowedHosts []string `json:"allowedHosts,omitempty"`
+
+	// AllowedPorts is the list of ports callbacks may be sent to. If omitted, all ports are allowed.
+	AllowedPorts []int32 `json:"allowedPorts,omitempty"`
+}
+
+// Namespaced tells if the operator is restricted to a list of namespaces or its own namespace.
+func (c *ErinnerungConfig) Namespaced() bool {
+	return c.OwnNamespace || len(c.Namespaces) > 0
+}
+
+// Allows tells if CallbackUrls in urlNamespace may receive CallbackPayloads from payloadNamespace. A CallbackUrl
+// may always receive CallbackPayloads from its own namespace.
+func (p *CrossNamespacePolicy) Allows(urlNamespace, payloadNamespace string) bool {
+	if urlNamespace == payloadNamespace {
+		return true
+	}
+	if p == nil || !p.Enabled {
+		return false
+	}
+
+	for _, rule := range p.Rules {
+		if rule.CallbackUrlNamespace != urlNamespace {
+			continue
+		}
+		for _, ns := range rule.PayloadNamespaces {
+			if ns == "*" || ns == payloadNamespace {
+				return true
+			}
+		}
+	}
+
+	return false
+}
 
 func init() {
 	SchemeBuilder.Register(&ErinnerungConfig{})
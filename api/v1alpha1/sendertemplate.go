@@ -0,0 +1,55 @@
+/*
+Copyright (C) 2022 Christoph Görn
+
+This file is part of r-gespraech.
+
+r-gespraech is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+r-gespraech is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with r-gespraech.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package v1alpha1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+)
+
+// SenderContainerName is the name of the sender container, a senderTemplate customizes it by using that name.
+const SenderContainerName = "curl-sender"
+
+// RestrictSenderTemplate returns the subset of a CallbackUrl's senderTemplate the tenants of a namespace may
+// customize: the image and resources of the sender container, the node selector and the tolerations. Anything else,
+// e.g. the service account, volumes or further containers, is reserved to the senderTemplate of the ErinnerungConfig
+// and of ClusterCallbackUrls.
+func RestrictSenderTemplate(template *corev1.PodTemplateSpec) *corev1.PodTemplateSpec {
+	if template == nil {
+		return nil
+	}
+
+	restricted := &corev1.PodTemplateSpec{
+		Spec: corev1.PodSpec{
+			NodeSelector: template.Spec.NodeSelector,
+			Tolerations:  template.Spec.Tolerations,
+		},
+	}
+	for _, c := range template.Spec.Containers {
+		if c.Name == SenderContainerName {
+			restricted.Spec.Containers = append(restricted.Spec.Containers, corev1.Container{
+				Name:      c.Name,
+				Image:     c.Image,
+				Resources: c.Resources,
+			})
+		}
+	}
+
+	return restricted
+}
@@ -0,0 +1,204 @@
+/*
+Copyright (C) 2022 Christoph Görn
+
+This file is part of r-gespraech.
+
+r-gespraech is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+r-gespraech is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with r-gespraech.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	kbatch "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	erinnerungv1alpha1 "github.com/goern/r-gespraech/api/v1alpha1"
+)
+
+const (
+	// defaultRetryAfter is the pause after a back-pressure response without a valid Retry-After header.
+	defaultRetryAfter = time.Minute
+	// maxRetryAfter caps the pause a receiver may ask for.
+	maxRetryAfter = time.Hour
+	// maxBackPressureAttempts is the number of back-pressure responses not counted against the maxAttempts of a
+	// callback, any further ones are.
+	maxBackPressureAttempts = 10
+
+	// retryBackoff is the delay before the second attempt of a failed delivery, it doubles with every further failure.
+	retryBackoff = 10 * time.Second
+	// maxRetryBackoff caps the delay between the attempts of a failed delivery.
+	maxRetryBackoff = 10 * time.Minute
+)
+
+// isBackPressure tells if the HTTP status asks the sender to slow down: 429 Too Many Requests or 503 Service
+// Unavailable.
+func isBackPressure(status int32) bool {
+	return status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable
+}
+
+// parseRetryAfter returns the pause asked for by a Retry-After header received at the time, either delay-seconds or
+// an HTTP-date (RFC 9110). It falls back to defaultRetryAfter and is capped by maxRetryAfter.
+func parseRetryAfter(value string, received time.Time) time.Duration {
+	value = strings.TrimSpace(value)
+	pause := defaultRetryAfter
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil && seconds >= 0 {
+		pause = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(value); err == nil {
+		pause = date.Sub(received)
+	}
+
+	if pause < 0 {
+		return 0
+	}
+	if pause > maxRetryAfter {
+		return maxRetryAfter
+	}
+	return pause
+}
+
+// jobBackPressure returns the time the receiver asked the sender Job to retry after, if it responded with
+// back-pressure.
+func jobBackPressure(job *kbatch.Job) (time.Time, bool) {
+	value, ok := job.Annotations[erinnerungv1alpha1.BackPressureAnnotation]
+	if !ok {
+		return time.Time{}, false
+	}
+	until, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return until, true
+}
+
+// markBackPressure records the time the receiver asked the sender Job to retry after in its annotations, the pods
+// telling about it may be gone before the next attempt.
+func (r *CallbackUrlReconciler) markBackPressure(ctx context.Context, job *kbatch.Job, until time.Time) error {
+	if _, ok := jobBackPressure(job); ok {
+		return nil
+	}
+
+	patch := client.MergeFrom(job.DeepCopy())
+	if job.Annotations == nil {
+		job.Annotations = map[string]string{}
+	}
+	job.Annotations[erinnerungv1alpha1.BackPressureAnnotation] = until.UTC().Format(time.RFC3339)
+
+	return r.Patch(ctx, job, patch)
+}
+
+// pausedUntil returns the latest time any receiver response asked the sender Jobs to retry after, the deliveries of
+// the callback are paused until then.
+func pausedUntil(jobs []kbatch.Job) *metav1.Time {
+	var latest *metav1.Time
+	for i := range jobs {
+		if until, ok := jobBackPressure(&jobs[i]); ok && (latest == nil || until.After(latest.Time)) {
+			latest = &metav1.Time{Time: until}
+		}
+	}
+
+	return latest
+}
+
+// backoffUntil returns the time the failed delivery of the payload's delivery generation may be attempted again: the
+// latest failure plus a backoff doubling with every failure. Back-pressure responses are not counted, the receiver
+// paused the deliveries after them.
+func backoffUntil(callback erinnerungv1alpha1.Callback, p *erinnerungv1alpha1.CallbackPayload, jobs []kbatch.Job) *metav1.Time {
+	var latest time.Time
+	failures := 0
+	generation := deliveryGeneration(callback, p)
+	for i := range jobs {
+		j := &jobs[i]
+		if j.Labels[erinnerungv1alpha1.PayloadUIDLabel] != string(p.UID) || jobPayloadGeneration(j) != generation {
+			continue
+		}
+		if _, ok := jobBackPressure(j); ok {
+			continue
+		}
+		if failed, ok := jobFailedTime(j); ok {
+			failures++
+			if failed.After(latest) {
+				latest = failed
+			}
+		}
+	}
+	if failures == 0 {
+		return nil
+	}
+
+	backoff := maxRetryBackoff
+	if failures <= 16 && retryBackoff<<(failures-1) < maxRetryBackoff {
+		backoff = retryBackoff << (failures - 1)
+	}
+
+	return &metav1.Time{Time: latest.Add(backoff)}
+}
+
+// jobFailedTime returns the time the sender Job failed, if it did.
+func jobFailedTime(job *kbatch.Job) (time.Time, bool) {
+	for _, c := range job.Status.Conditions {
+		if c.Type == kbatch.JobFailed && c.Status == corev1.ConditionTrue {
+			return c.LastTransitionTime.Time, true
+		}
+	}
+
+	return time.Time{}, false
+}
+
+// maxAttempts returns the number of attempts delivering a payload, it defaults to 1.
+func maxAttempts(callback erinnerungv1alpha1.Callback) int {
+	if attempts := callback.CallbackSpec().MaxAttempts; attempts > 0 {
+		return int(attempts)
+	}
+	return 1
+}
+
+// retriesDelivery tells if the failed delivery of the payload's delivery generation is attempted again. The back-pressure
+// responses of the receiver are not counted against the maxAttempts of the callback, up to maxBackPressureAttempts.
+func retriesDelivery(callback erinnerungv1alpha1.Callback, p *erinnerungv1alpha1.CallbackPayload, jobs []kbatch.Job) bool {
+	d := p.FindDelivery(callback.GetUID())
+	generation := deliveryGeneration(callback, p)
+	if d == nil || d.Phase != erinnerungv1alpha1.CallbackPayloadFailed || d.ObservedGeneration != generation {
+		return false
+	}
+
+	failed, throttled := 0, 0
+	for i := range jobs {
+		j := &jobs[i]
+		if j.Labels[erinnerungv1alpha1.PayloadUIDLabel] != string(p.UID) || jobPayloadGeneration(j) != generation {
+			continue
+		}
+		if finished, jobFailed := jobFinished(j); !finished || !jobFailed {
+			continue
+		}
+		if _, ok := jobBackPressure(j); ok {
+			throttled++
+		} else {
+			failed++
+		}
+	}
+	if throttled > maxBackPressureAttempts {
+		failed += throttled - maxBackPressureAttempts
+	}
+
+	return failed < maxAttempts(callback)
+}
@@ -22,6 +22,7 @@ package controllers
 import (
 	"context"
 
+	kbatch "k8s.io/api/batch/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
@@ -40,21 +41,35 @@ type CallbackPayloadReconciler struct {
 //+kubebuilder:rbac:groups=erinnerung.thoth-station.ninja,resources=callbackpayloads/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=erinnerung.thoth-station.ninja,resources=callbackpayloads/finalizers,verbs=update
 
+//+kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;watch;delete
+
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
-// move the current state of the cluster closer to the desired state.
-// TODO(user): Modify the Reconcile function to compare the state specified by
-// the CallbackPayload object against the actual cluster state, and then
-// perform operations to make the cluster state reflect the state specified by
-// the user.
+// move the current state of the cluster closer to the desired state. Deleting a CallbackPayload cancels its pending
+// and active deliveries.
 //
 // For more details, check Reconcile and its Result here:
 // - https://pkg.go.dev/sigs.k8s.io/controller-runtime@v0.11.0/pkg/reconcile
 func (r *CallbackPayloadReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
-	_ = log.FromContext(ctx)
+	logger := log.FromContext(ctx)
+
+	var payload erinnerungv1alpha1.CallbackPayload
+	if err := r.Get(ctx, req.NamespacedName, &payload); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
 
-	// TODO(user): your logic here
+	// the sender Jobs are in the namespaces of the CallbackUrls, or the sender namespace
+	_, err := finalize(ctx, r.Client, &payload, func() error {
+		var senderJobs kbatch.JobList
+		if err := r.List(ctx, &senderJobs, client.MatchingLabels{erinnerungv1alpha1.PayloadUIDLabel: string(payload.UID)}); err != nil {
+			return err
+		}
+		return cancelDeliveries(ctx, r.Client, senderJobs.Items)
+	})
+	if err != nil {
+		logger.Error(err, "unable to finalize the CallbackPayload")
+	}
 
-	return ctrl.Result{}, nil
+	return ctrl.Result{}, err
 }
 
 // SetupWithManager sets up the controller with the Manager.
@@ -0,0 +1,100 @@
+/*
+Copyright (C) 2022 Christoph Görn
+
+This file is part of r-gespraech.
+
+r-gespraech is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+r-gespraech is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with r-gespraech.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"time"
+
+	kbatch "k8s.io/api/batch/v1"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/goern/r-gespraech/api/v1alpha1"
+)
+
+// these specs are meant to be run with the race detector (`make test-race`), the suite reconciles concurrently
+var _ = Describe("CallbackUrl controller reconciling concurrently", func() {
+	var testNamespace string
+	const (
+		count = 20
+
+		timeout  = time.Second * 30
+		interval = time.Millisecond * 250
+	)
+
+	BeforeEach(func() {
+		testNamespace = "test-" + String(6)
+		nsSpec := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: testNamespace}}
+		Expect(k8sClient.Create(ctx, nsSpec)).Should(Succeed())
+	})
+
+	Context("When creating many CallbackUrls, each with one associated CallbackPayload", func() {
+		It("Should associate each CallbackUrl with its own CallbackPayload", func() {
+			By("By creating the CallbackUrls and CallbackPayloads")
+			for i := 0; i < count; i++ {
+				name := fmt.Sprintf("parallel-%d", i)
+				Expect(k8sClient.Create(ctx, generateCallbackUrl(name, testNamespace, "https://localhost.local:8181/webhook/"+name))).Should(Succeed())
+				Expect(k8sClient.Create(ctx, generateCallbackPayload(name, testNamespace))).Should(Succeed())
+			}
+
+			By("By checking every CallbackUrl has an AssociatedPayloads Condition set to True")
+			for i := 0; i < count; i++ {
+				lookupKey := types.NamespacedName{Name: fmt.Sprintf("parallel-%d", i), Namespace: testNamespace}
+				callbackUrl := &v1alpha1.CallbackUrl{}
+				Eventually(func() (bool, error) {
+					err := k8sClient.Get(ctx, lookupKey, callbackUrl)
+					if err != nil {
+						return false, err
+					}
+					return meta.IsStatusConditionTrue(callbackUrl.Status.Conditions, v1alpha1.AssociatedPayloads), nil
+				}, timeout, interval).Should(BeTrue())
+			}
+
+			By("By checking every CallbackUrl's Job delivers its own CallbackPayload")
+			for i := 0; i < count; i++ {
+				lookupKey := types.NamespacedName{Name: fmt.Sprintf("parallel-%d", i), Namespace: testNamespace}
+				callbackUrl := &v1alpha1.CallbackUrl{}
+				Expect(k8sClient.Get(ctx, lookupKey, callbackUrl)).To(Succeed())
+				callbackPayload := &v1alpha1.CallbackPayload{}
+				Expect(k8sClient.Get(ctx, lookupKey, callbackPayload)).To(Succeed())
+
+				var jobs kbatch.JobList
+				Eventually(func() (int, error) {
+					err := k8sClient.List(ctx, &jobs, client.InNamespace(testNamespace), client.MatchingLabels{v1alpha1.CallbackUIDLabel: string(callbackUrl.UID)})
+					return len(jobs.Items), err
+				}, timeout, interval).Should(Equal(1))
+				Expect(jobs.Items[0].Labels).To(HaveKeyWithValue(v1alpha1.PayloadUIDLabel, string(callbackPayload.UID)))
+
+				// no other CallbackUrl delivers this CallbackPayload
+				Expect(k8sClient.List(ctx, &jobs, client.InNamespace(testNamespace), client.MatchingLabels{v1alpha1.PayloadUIDLabel: string(callbackPayload.UID)})).To(Succeed())
+				for _, j := range jobs.Items {
+					Expect(j.Labels).To(HaveKeyWithValue(v1alpha1.CallbackUIDLabel, string(callbackUrl.UID)))
+				}
+			}
+		})
+	})
+})
@@ -21,21 +21,32 @@ package controllers
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	stderrors "errors"
 	"fmt"
+	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	kbatch "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
-	v1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/pointer"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
 	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/predicate"
@@ -48,8 +59,9 @@ import (
 
 const (
 	RequeueAfter = 10 * time.Second
-	adviserIdKey = "adviser.thoth-station.ninja/adviser-id"
 	jobOwnerKey  = ".metadata.controller"
+	// clusterJobOwnerKey indexes the Jobs owned by ClusterCallbackUrls
+	clusterJobOwnerKey = ".metadata.controller.cluster"
 )
 
 var (
@@ -59,24 +71,74 @@ var (
 // CallbackUrlReconciler reconciles a CallbackUrl object
 type CallbackUrlReconciler struct {
 	client.Client
-	Scheme      *runtime.Scheme
-	CallbackUrl *v1alpha1.CallbackUrl
+	Scheme *runtime.Scheme
+
+	// EgressPolicy restricts the callback targets, nil applies the defaults.
+	EgressPolicy *v1alpha1.EgressPolicy
+	// Resolver is used to resolve callback targets, it defaults to net.DefaultResolver.
+	Resolver Resolver
+	// CrossNamespace controls which CallbackPayloads a CallbackUrl with a `namespaceSelector` receives.
+	CrossNamespace *v1alpha1.CrossNamespacePolicy
+	// Namespaced restricts the operator to a list of namespaces, the namespaces can not be listed by their labels.
+	Namespaced bool
+	// SenderNamespace is the namespace the sender Jobs of ClusterCallbackUrls are created in.
+	SenderNamespace string
+	// MaxConcurrentReconciles is the maximum number of concurrent reconciles, it defaults to 1.
+	MaxConcurrentReconciles int
+	// CorrelationKey is the key of a CallbackPayload label copied to its sender Jobs, a CallbackUrl may override it.
+	CorrelationKey string
+	// IdempotencyKeyHeader is the name of the request header carrying the delivery ID, a CallbackUrl may override it.
+	IdempotencyKeyHeader string
+	// SenderTemplate customizes the pod template of the sender Jobs, a CallbackUrl may override it.
+	SenderTemplate *corev1.PodTemplateSpec
+	// APIReader reads the objects that are not cached, e.g. the pods of the sender Jobs. It defaults to the Client.
+	APIReader client.Reader
+	// SenderNetworkPolicies enables a NetworkPolicy per callback, limiting the egress of its sender Jobs to the target.
+	SenderNetworkPolicies bool
+	// Recorder records the Events of the callbacks, e.g. their automatic suspension.
+	Recorder record.EventRecorder
+	// Keyring signs the deliveries in the SigningFormat, they are not signed if it is nil.
+	Keyring *Keyring
+	// SigningFormat is the format of the signature headers, it defaults to a detached JWS.
+	SigningFormat string
+	// PriorityAging is the time a waiting payload takes to gain a priority of 1, it defaults to defaultPriorityAging.
+	PriorityAging time.Duration
+
+	// selectors maps CallbackPayloads to the callbacks selecting them
+	selectors *selectorIndex
+	// checks runs the probes and verifications of the callback targets in the background
+	checks *targetChecks
 }
 
-//+kubebuilder:rbac:groups=erinnerung.thoth-station.ninka,resources=callbackpayloads,verbs=get;list;watch
-//+kubebuilder:rbac:groups=erinnerung.thoth-station.ninka,resources=callbackpayloads/status,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=erinnerung.thoth-station.ninja,resources=callbackpayloads,verbs=get;list;watch
+//+kubebuilder:rbac:groups=erinnerung.thoth-station.ninja,resources=callbackpayloads/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=erinnerung.thoth-station.ninja,resources=callbackurls,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=erinnerung.thoth-station.ninja,resources=callbackurls/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=erinnerung.thoth-station.ninja,resources=callbackurls/finalizers,verbs=update
+//+kubebuilder:rbac:groups="",resources=services;endpoints,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=namespaces,verbs=get;list;watch
+//+kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=batch,resources=jobs/status,verbs=get
+//+kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+//+kubebuilder:rbac:groups="",resources=pods,verbs=get;list
+//+kubebuilder:rbac:groups="",resources=secrets,verbs=get;create;update;delete
+//+kubebuilder:rbac:groups=networking.k8s.io,resources=networkpolicies,verbs=get;list;watch;create;update;patch;delete
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
 func (r *CallbackUrlReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	callback := &v1alpha1.CallbackUrl{}
+	result, err := r.reconcileCallback(ctx, req, callback)
+
+	return r.requeueChecks(callback, result), err
+}
+
+// reconcileCallback is the delivery machinery shared by CallbackUrls and ClusterCallbackUrls.
+func (r *CallbackUrlReconciler) reconcileCallback(ctx context.Context, req ctrl.Request, callback v1alpha1.Callback) (ctrl.Result, error) {
 	logger := log.FromContext(ctx)
 
 	// find myself
-	r.CallbackUrl = &v1alpha1.CallbackUrl{}
-	if err := r.Get(ctx, req.NamespacedName, r.CallbackUrl); err != nil {
+	if err := r.Get(ctx, req.NamespacedName, callback); err != nil {
 		if errors.IsNotFound(err) {
 			return ctrl.Result{}, nil
 		}
@@ -84,30 +146,94 @@ func (r *CallbackUrlReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 		return ctrl.Result{Requeue: true}, err
 	}
 
-	if !r.CallbackUrl.ObjectMeta.DeletionTimestamp.IsZero() {
+	// cancel the deliveries and the checks of a deleted callback
+	deleted, err := finalize(ctx, r.Client, callback, func() error {
+		r.checks.cancel(callback.GetUID())
+
+		var senderJobs kbatch.JobList
+		if err := r.List(ctx, &senderJobs, client.InNamespace(r.jobNamespace(callback)), client.MatchingFields{jobOwnerKeyFor(callback): req.Name}); err != nil {
+			return err
+		}
+		return cancelDeliveries(ctx, r.Client, senderJobs.Items)
+	})
+	if err != nil {
+		logger.Error(err, "unable to finalize the resource")
+		return ctrl.Result{}, err
+	}
+	if deleted {
 		logger.Info("Resource being delete, skipping further reconcile.")
 		return ctrl.Result{}, nil
 	}
 
-	r.CallbackUrl.Status.Phase = r.CallbackUrl.AggregatePhase()
+	setSuspendedCondition(callback)
+	activate(callback)
+
+	// figure out where to send the payloads to
+	var targetURL, targetResolve string
+	var targetAllowed []string
+	inCluster := false
+	if ref := callback.CallbackSpec().ServiceRef; ref != nil {
+		// the webhook may not be enabled, a CallbackUrl must not reach the Services of other namespaces
+		if ns := callback.GetNamespace(); ns != "" && serviceRefNamespace(ref, ns) != ns {
+			err := newServiceUnavailable("CrossNamespaceServiceRef", fmt.Sprintf("the Service %s/%s is not in the namespace of the CallbackUrl", ref.Namespace, ref.Name))
+			return r.conditionErrorOrRequeue(ctx, callback, err, "unable to resolve Service reference")
+		}
+		resolved, internal, err := r.resolveServiceRef(ctx, ref, r.jobNamespace(callback))
+		if err != nil {
+			return r.conditionErrorOrRequeue(ctx, callback, err, "unable to resolve Service reference")
+		}
+		setCondition(callback, v1alpha1.ServiceAvailable, metav1.ConditionTrue, "ServiceResolved", fmt.Sprintf("the Service resolved to %s", resolved))
+		targetURL = resolved
+		inCluster = internal
+	} else {
+		meta.RemoveStatusCondition(&callback.CallbackStatus().Conditions, v1alpha1.ServiceAvailable)
 
-	// TODO: this needs to be refactored into a validating webhook
-	if r.CallbackUrl.Spec.URL == "" {
-		r.SetCondition("URL", metav1.ConditionFalse, "EmptyUrl", "the provided URL is empty")
-		return r.UpdateStatusNow(ctx, nil)
+		// TODO: this needs to be refactored into a validating webhook
+		if callback.CallbackSpec().URL == "" {
+			setCondition(callback, "URL", metav1.ConditionFalse, "EmptyUrl", "the provided URL is empty")
+			return r.UpdateStatusNow(ctx, callback, nil)
+		}
+		if _, err := url.Parse(callback.CallbackSpec().URL); err != nil {
+			logger.Error(err, "URL not parsable")
+			return r.UpdateStatusNow(ctx, callback, err)
+		} else {
+			setCondition(callback, "URL", metav1.ConditionTrue, "GoodUrl", "the provided URL good")
+		}
+		targetURL = callback.CallbackSpec().URL
 	}
-	if _, err := url.Parse(r.CallbackUrl.Spec.URL); err != nil {
-		logger.Error(err, "URL not parsable")
-		return r.UpdateStatusNow(ctx, err)
+
+	// targets outside of the cluster must pass the EgressPolicy, in-cluster Services are left to NetworkPolicies
+	if inCluster {
+		meta.RemoveStatusCondition(&callback.CallbackStatus().Conditions, v1alpha1.EgressAllowed)
 	} else {
-		r.SetCondition("URL", metav1.ConditionTrue, "GoodUrl", "the provided URL good")
+		resolve, allowed, err := r.checkEgress(ctx, targetURL)
+		if err != nil {
+			return r.conditionErrorOrRequeue(ctx, callback, err, "unable to check the EgressPolicy")
+		}
+		setCondition(callback, v1alpha1.EgressAllowed, metav1.ConditionTrue, "EgressAllowed", "the callback target is allowed by the EgressPolicy")
+		targetResolve = resolve
+		targetAllowed = allowed
+	}
+
+	guard := !unguardedTarget(callback, inCluster)
+	r.probe(ctx, callback, targetURL, guard)
+	if err := r.verify(ctx, callback, targetURL, guard); err != nil {
+		logger.Error(err, "unable to suspend the unverified callback")
+		return r.UpdateStatusNow(ctx, callback, err)
+	}
+
+	if r.SenderNetworkPolicies {
+		if err := r.reconcileNetworkPolicy(ctx, callback, targetURL, targetAllowed); err != nil {
+			logger.Error(err, "unable to reconcile the NetworkPolicy of the sender Jobs")
+			return r.UpdateStatusNow(ctx, callback, err)
+		}
 	}
 
 	// get the list of payloads this url needs to work on
 	var associatedPayloads erinnerungv1alpha1.CallbackPayloadList
-	payloadSelector, err := metav1.LabelSelectorAsSelector(&r.CallbackUrl.Spec.Selector)
+	payloadSelector, err := metav1.LabelSelectorAsSelector(&callback.CallbackSpec().Selector)
 	if err != nil {
-		return r.UpdateStatusNow(ctx, err)
+		return r.UpdateStatusNow(ctx, callback, err)
 	}
 
 	options := client.ListOptions{
@@ -115,204 +241,422 @@ func (r *CallbackUrlReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 		Raw:           &metav1.ListOptions{},
 	}
 
-	if err := r.List(ctx, &associatedPayloads, client.InNamespace(req.Namespace), &options); err != nil {
-		logger.Error(err, "unable to list associated CallbackPayloads")
-		return r.UpdateStatusNow(ctx, err)
+	namespaces, err := r.payloadNamespaces(ctx, callback)
+	if err != nil {
+		return r.conditionErrorOrRequeue(ctx, callback, err, "unable to list the namespaces of associated CallbackPayloads")
+	}
+	if callback.CallbackSpec().NamespaceSelector != nil {
+		setCondition(callback, v1alpha1.CrossNamespaceAllowed, metav1.ConditionTrue, "CrossNamespaceAllowed", fmt.Sprintf("receiving CallbackPayloads from the namespaces %v", namespaces))
+	} else {
+		meta.RemoveStatusCondition(&callback.CallbackStatus().Conditions, v1alpha1.CrossNamespaceAllowed)
+	}
+
+	for _, ns := range namespaces {
+		var payloads erinnerungv1alpha1.CallbackPayloadList
+		if err := r.List(ctx, &payloads, client.InNamespace(ns), &options); err != nil {
+			logger.Error(err, "unable to list associated CallbackPayloads")
+			return r.UpdateStatusNow(ctx, callback, err)
+		}
+		associatedPayloads.Items = append(associatedPayloads.Items, payloads.Items...)
 	}
 
 	if len(associatedPayloads.Items) == 0 {
-		meta.RemoveStatusCondition(&r.CallbackUrl.Status.Conditions, "AssociatedPayloads") // TODO err handler
-		r.SetCondition(v1alpha1.NoAssociatedPayloads, metav1.ConditionTrue, "NoAssociatedPayloads", "there is not associated CallbackPayload for this CallbackURL")
+		meta.RemoveStatusCondition(&callback.CallbackStatus().Conditions, "AssociatedPayloads") // TODO err handler
+		setCondition(callback, v1alpha1.NoAssociatedPayloads, metav1.ConditionTrue, "NoAssociatedPayloads", "there is not associated CallbackPayload for this CallbackURL")
 	} else {
-		meta.RemoveStatusCondition(&r.CallbackUrl.Status.Conditions, "NoAssociatedPayloads") // TODO err handler
-		r.SetCondition(v1alpha1.AssociatedPayloads, metav1.ConditionTrue, "AssociatedPayloads", fmt.Sprintf("there is %v associated CallbackPayload for this CallbackURL", len(associatedPayloads.Items)))
+		meta.RemoveStatusCondition(&callback.CallbackStatus().Conditions, "NoAssociatedPayloads") // TODO err handler
+		setCondition(callback, v1alpha1.AssociatedPayloads, metav1.ConditionTrue, "AssociatedPayloads", fmt.Sprintf("there is %v associated CallbackPayload for this CallbackURL", len(associatedPayloads.Items)))
 	}
 
 	// Update Payload conditions based on the Jobs this PayloadUrl owns.
 	// get the list of active sender jobs
 	var senderJobs kbatch.JobList
-	if err := r.List(ctx, &senderJobs, client.InNamespace(req.Namespace), client.MatchingFields{jobOwnerKey: req.Name}); err != nil {
+	if err := r.List(ctx, &senderJobs, client.InNamespace(r.jobNamespace(callback)), client.MatchingFields{jobOwnerKeyFor(callback): req.Name}); err != nil {
 		logger.Error(err, "unable to list child Jobs")
-		return r.UpdateStatusNow(ctx, err)
+		return r.UpdateStatusNow(ctx, callback, err)
 	}
 
-	// have a look at all senderJobs
-	for _, j := range senderJobs.Items {
+	// have a look at all senderJobs, and propagate the state of the latest attempts to the deliveries of the payloads
+	latestJobs, latestCompleteJobs := latestSenderJobs(senderJobs.Items)
+	changedPayloads := map[*v1alpha1.CallbackPayload]bool{}
+	for i := range senderJobs.Items {
+		j := &senderJobs.Items[i]
+		payloadUID := j.Labels[v1alpha1.PayloadUIDLabel]
 		logger.WithValues("sender job", j.ObjectMeta.Name).Info("")
-		// and their conditions
-		for _, c := range j.Status.Conditions {
-			// if the job was completed or failed...
-			if (c.Type == kbatch.JobComplete || c.Type == kbatch.JobFailed) && c.Status == corev1.ConditionTrue {
-				// let's propagate that to the payload
-				p := r.findPayloadForJob(associatedPayloads.Items, j)
-				logger.WithValues("sender job", j.ObjectMeta.Name).WithValues("payload", p.ObjectMeta.Name).Info("")
-				// and their conditions
-				meta.SetStatusCondition(&p.Status.Conditions, metav1.Condition{
-					Type:    v1alpha1.CallbackPayloadComplete,
-					Status:  metav1.ConditionTrue,
-					Reason:  "PayloadSend",
-					Message: fmt.Sprintf("The Payload has been send by Job %v", j.ObjectMeta.Name),
-				})
+
+		finished, failed := jobFinished(j)
+		// the request is not needed anymore, unless it is the document the next patch is created from
+		if finished && !(r.onUpdate(callback) == v1alpha1.OnUpdateDeliverPatch && latestCompleteJobs[payloadUID] == j) {
+			if err := r.deleteRequestSecret(ctx, j); err != nil {
+				logger.Error(err, "unable to delete the request Secret of the Job", "job", j.Name)
 			}
 		}
-		if j.Status.Active == 1 {
-			p := r.findPayloadForJob(associatedPayloads.Items, j)
-			meta.SetStatusCondition(&p.Status.Conditions, metav1.Condition{
-				Type:    v1alpha1.CallbackPayloadSending,
-				Status:  metav1.ConditionTrue,
-				Reason:  "PayloadSending",
-				Message: fmt.Sprintf("The Payload is been send by Job %v", j.ObjectMeta.Name),
-			})
 
+		if latestJobs[payloadUID] != j {
+			// the Job of an older attempt
+			continue
+		}
+		p := r.findPayloadForJob(associatedPayloads.Items, *j)
+		if p == nil {
+			continue
+		}
+		existing := p.FindDelivery(callback.GetUID())
+
+		var delivery v1alpha1.CallbackPayloadDelivery
+		switch {
+		case finished:
+			if existing != nil && existing.Job == j.Name && existing.Phase != v1alpha1.CallbackPayloadSending {
+				// the result of the Job has been recorded already
+				continue
+			}
+			d, err := r.finishedDelivery(ctx, callback, j, failed)
+			if err != nil {
+				logger.Error(err, "unable to read the result of the Job", "job", j.Name)
+			}
+			if d.HTTPStatus == http.StatusGone && !callback.CallbackSpec().Suspend {
+				// the receiver has been retired
+				if err := r.suspend(ctx, callback, "ReceiverGone", fmt.Sprintf("the receiver responded 410 Gone to the Job %s, the deliveries are suspended", j.Name)); err != nil {
+					logger.Error(err, "unable to suspend the callback")
+					return r.UpdateStatusNow(ctx, callback, err)
+				}
+			}
+			if d.RetryAfter != nil {
+				if err := r.markBackPressure(ctx, j, d.RetryAfter.Time); err != nil {
+					logger.Error(err, "unable to record the back-pressure of the receiver", "job", j.Name)
+					return r.UpdateStatusNow(ctx, callback, err)
+				}
+			}
+			delivery = d
+		case j.Status.Active > 0:
+			delivery = v1alpha1.CallbackPayloadDelivery{
+				Callback:           callbackReference(callback),
+				CallbackUID:        callback.GetUID(),
+				Phase:              v1alpha1.CallbackPayloadSending,
+				Job:                j.Name,
+				ObservedGeneration: jobPayloadGeneration(j),
+				DeliveryID:         j.Annotations[v1alpha1.DeliveryIDAnnotation],
+				ContentHash:        j.Annotations[v1alpha1.ContentHashAnnotation],
+			}
+		default:
+			continue
 		}
 
+		logger.WithValues("sender job", j.ObjectMeta.Name).WithValues("payload", p.ObjectMeta.Name).Info(delivery.Phase)
+		if p.SetDelivery(delivery) {
+			setDeliveryConditions(p)
+			changedPayloads[p] = true
+		}
 	}
 
-	//TODO update payload condition
+	for p := range changedPayloads {
+		if err := r.Status().Update(ctx, p); err != nil {
+			logger.WithValues("payload", p.Name, "reason", err.Error()).Info("Unable to update the payload status, retrying")
+			return ctrl.Result{Requeue: true}, nil
+		}
+	}
 
 	// now we know we have some payloads associated with this url, let's see if we need to send a payload
 	var unsendPayloads []*v1alpha1.CallbackPayload
-	var sentPayloads []*v1alpha1.CallbackPayload
 
-	// TODO shall we put this in a func() what is the difference!?
-	isPayloadSent := func(p *v1alpha1.CallbackPayload) (bool, string) {
-		for _, c := range p.Status.Conditions {
-			if (c.Type == v1alpha1.CallbackPayloadComplete || c.Type == v1alpha1.CallbackPayloadFailed) && c.Status == metav1.ConditionTrue {
-				return true, c.Type
+	for i := range associatedPayloads.Items {
+		p := &associatedPayloads.Items[i]
+		if !p.DeletionTimestamp.IsZero() {
+			// its deliveries are being cancelled
+			continue
+		}
+		if !r.needsDelivery(callback, p) && !retriesDelivery(callback, p, senderJobs.Items) {
+			continue
+		}
+		if ok, err := deliversExisting(callback, p); err != nil || !ok {
+			if err != nil {
+				logger.Error(err, "invalid deliverExisting policy")
 			}
+			continue
 		}
+		unsendPayloads = append(unsendPayloads, p)
+	}
+	unsendPayloads = r.orderPayloads(callback, unsendPayloads)
+	r.prioritizePayloads(unsendPayloads, time.Now())
 
-		return false, ""
+	if callback.CallbackSpec().Suspend {
+		logger.Info("the callback is suspended, its payloads are kept", "unsent", len(unsendPayloads))
+		return r.UpdateStatusNow(ctx, callback, nil)
 	}
 
-	for i, p := range associatedPayloads.Items {
-		_, finishedType := isPayloadSent(&p)
+	if !verified(callback) {
+		logger.Info("the receiver is not verified, its payloads are kept", "unsent", len(unsendPayloads))
+		return r.UpdateStatusNow(ctx, callback, nil)
+	}
 
-		switch finishedType {
-		case "":
-			unsendPayloads = append(unsendPayloads, &associatedPayloads.Items[i])
-		case v1alpha1.CallbackPayloadComplete:
-		case v1alpha1.CallbackPayloadFailed:
-			sentPayloads = append(sentPayloads, &associatedPayloads.Items[i])
+	// the receiver asked to slow down, every pending delivery waits until it may be retried
+	until := pausedUntil(senderJobs.Items)
+	if until != nil && !time.Now().Before(until.Time) {
+		until = nil
+	}
+	callback.CallbackStatus().PausedUntil = until
+	if until != nil && len(unsendPayloads) > 0 {
+		logger.Info("the receiver asked to retry later, deliveries are paused", "until", until)
+		result, err := r.UpdateStatusNow(ctx, callback, nil)
+		if err == nil && !result.Requeue {
+			result.RequeueAfter = time.Until(until.Time)
 		}
-
+		return result, err
 	}
 
-	// let's send out the unsent payloads
+	// let's send out the unsent payloads, by priority as long as there are free delivery slots
+	maxActive := callback.CallbackSpec().MaxActiveDeliveries
+	active := activeDeliveries(senderJobs.Items)
+	// the earliest time a failed delivery backing off may be attempted again
+	var retryAt *metav1.Time
+unsent:
 	for _, unsend := range unsendPayloads {
 		// check if the unsend payload has a job which is not finished yet
 		for _, sender := range senderJobs.Items {
-			// if so, return and continue reconciliation later
-			if sender.ObjectMeta.Labels[adviserIdKey] == unsend.ObjectMeta.Labels[adviserIdKey] {
+			// if so, skip it and continue reconciliation once the job finishes
+			if finished, _ := jobFinished(&sender); !finished && sender.ObjectMeta.Labels[v1alpha1.PayloadUIDLabel] == string(unsend.UID) {
 				logger.WithValues("payload", unsend.ObjectMeta.Name).WithValues("job", sender.ObjectMeta.Name).Info("unsent payload, with unfinished job")
-				return r.UpdateStatusNow(ctx, nil)
+				continue unsent
 			}
 		}
 
-		// payload needs to be send and there is no unfinished job for it
+		// a failed delivery is attempted again once its backoff has passed
+		if until := backoffUntil(callback, unsend, senderJobs.Items); until != nil && time.Now().Before(until.Time) {
+			logger.WithValues("payload", unsend.ObjectMeta.Name).Info("the failed delivery is backing off", "until", until)
+			if retryAt == nil || until.Before(retryAt) {
+				retryAt = until
+			}
+			continue
+		}
+
+		// payload needs to be send and there is no unfinished job for it, unless it is a duplicate
+		if deduplicated, err := r.deduplicate(ctx, callback, unsend, associatedPayloads.Items); err != nil {
+			logger.Error(err, "unable to mark the payload as deduplicated", "payload", unsend.Name)
+			return r.UpdateStatusNow(ctx, callback, err)
+		} else if deduplicated {
+			continue
+		}
+		if maxActive > 0 && active >= maxActive {
+			// the waiting payloads are dispatched once a job finishes
+			logger.Info("maximum of active deliveries reached", "active", active)
+			break
+		}
 		logger.WithValues("unsentPayload", unsend.ObjectMeta).Info("unsent")
 
 		// actually make the job...
-		job, err := r.constructJob(unsend)
+		job, err := r.constructJob(callback, unsend, nextAttempt(senderJobs.Items, unsend), targetURL, targetResolve)
 		if err != nil {
 			logger.Error(err, "unable to construct Job")
-			return r.UpdateStatusNow(ctx, err)
+			return r.UpdateStatusNow(ctx, callback, err)
+		}
+		job.Annotations[v1alpha1.DeliveryAttemptAnnotation] = strconv.Itoa(nextDeliveryAttempt(senderJobs.Items, job.Annotations[v1alpha1.DeliveryIDAnnotation]))
+
+		// ...with its request...
+		secret, err := r.constructRequestSecret(ctx, callback, unsend, job, latestCompleteJobs[string(unsend.UID)], targetURL)
+		if err != nil {
+			logger.Error(err, "unable to construct the request Secret")
+			return r.UpdateStatusNow(ctx, callback, err)
+		}
+		secretCreated, err := r.createRequestSecret(ctx, secret)
+		if err != nil {
+			logger.Error(err, "unable to create the request Secret for CallbackUrl", "secret", secret.Name)
+			return r.UpdateStatusNow(ctx, callback, err)
 		}
 
-		// ...and create it on the cluster
+		// ...and create it on the cluster, the Job may already exist if the cache is lagging behind
 		if err := r.Create(ctx, job); err != nil {
+			if errors.IsAlreadyExists(err) {
+				same, getErr := r.existingAttempt(ctx, job)
+				if getErr == nil && same {
+					logger.Info("Job for CallbackUrl already exists", "job", job.Name)
+					active++
+					continue
+				}
+				if getErr == nil {
+					err = fmt.Errorf("the Job %s exists, but is not the attempt %s of the delivery %s", job.Name, job.Labels[v1alpha1.AttemptLabel], job.Annotations[v1alpha1.DeliveryIDAnnotation])
+				}
+			}
 			logger.Error(err, "unable to create Job for CallbackUrl", "job", job)
-			return r.UpdateStatusNow(ctx, err)
+			return r.UpdateStatusNow(ctx, callback, err)
+		}
+
+		if secretCreated {
+			if err := r.adoptRequestSecret(ctx, secret, job); err != nil {
+				// the Secret is still deleted once the Job finishes
+				logger.Error(err, "unable to hand the request Secret over to the Job", "secret", secret.Name)
+			}
 		}
 
+		active++
 		logger.Info("created Job for CallbackUrl", "job", job)
 	}
 
-	return r.UpdateStatusNow(ctx, nil)
+	result, err := r.UpdateStatusNow(ctx, callback, nil)
+	if err == nil && !result.Requeue && retryAt != nil {
+		result.RequeueAfter = time.Until(retryAt.Time)
+	}
+	return result, err
 }
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *CallbackUrlReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &kbatch.Job{}, jobOwnerKey, func(rawObj client.Object) []string {
-		// grab the job object, extract the owner...
-		job := rawObj.(*kbatch.Job)
-		owner := metav1.GetControllerOf(job)
-		if owner == nil {
-			return nil
-		}
-		// ...make sure it's a CronJob...
-		if owner.APIVersion != apiGroupVersion || owner.Kind != "CallbackUrl" {
+	if err := indexJobOwner(mgr, jobOwnerKey, "CallbackUrl"); err != nil {
+		return err
+	}
+
+	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &erinnerungv1alpha1.CallbackUrl{}, serviceRefKey, func(rawObj client.Object) []string {
+		// grab the CallbackUrl object, extract the Service reference...
+		u := rawObj.(*erinnerungv1alpha1.CallbackUrl)
+		if u.Spec.ServiceRef == nil {
 			return nil
 		}
 
-		// ...and if so, return it
-		return []string{owner.Name}
+		// ...and return it
+		return []string{serviceRefIndexValue(serviceRefNamespace(u.Spec.ServiceRef, u.Namespace), u.Spec.ServiceRef.Name)}
 	}); err != nil {
 		return err
 	}
 
+	r.selectors = newSelectorIndex()
+	if err := r.selectors.watch(mgr, &erinnerungv1alpha1.CallbackUrl{}); err != nil {
+		return err
+	}
+	r.checks = newTargetChecks()
+
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&erinnerungv1alpha1.CallbackUrl{}).
+		WithOptions(controller.Options{MaxConcurrentReconciles: r.MaxConcurrentReconciles}).
 		Owns(&kbatch.Job{}).
+		Owns(&networkingv1.NetworkPolicy{}).
 		Watches(
 			&source.Kind{Type: &erinnerungv1alpha1.CallbackPayload{}},
 			handler.EnqueueRequestsFromMapFunc(r.findObjectsCallbackPayload),
 			builder.WithPredicates(predicate.ResourceVersionChangedPredicate{}),
 		).
+		Watches(
+			&source.Kind{Type: &corev1.Service{}},
+			handler.EnqueueRequestsFromMapFunc(r.findObjectsForService),
+		).
+		Watches(
+			&source.Kind{Type: &corev1.Endpoints{}},
+			handler.EnqueueRequestsFromMapFunc(r.findObjectsForService),
+		).
+		Watches(
+			&source.Channel{Source: r.checks.finished},
+			&handler.EnqueueRequestForObject{},
+		).
 		Complete(r)
 }
 
-func (r *CallbackUrlReconciler) findPayloadForJob(payloads []erinnerungv1alpha1.CallbackPayload, job kbatch.Job) *erinnerungv1alpha1.CallbackPayload {
-	for _, p := range payloads {
-		if p.ObjectMeta.Labels[adviserIdKey] == job.ObjectMeta.Labels[adviserIdKey] {
-			return &p
+// indexJobOwner indexes the sender Jobs by the name of their owning CallbackUrl or ClusterCallbackUrl.
+func indexJobOwner(mgr ctrl.Manager, key, kind string) error {
+	return mgr.GetFieldIndexer().IndexField(context.Background(), &kbatch.Job{}, key, func(rawObj client.Object) []string {
+		// grab the job object, extract the owner...
+		job := rawObj.(*kbatch.Job)
+		owner := metav1.GetControllerOf(job)
+		if owner == nil {
+			return nil
+		}
+		// ...make sure it's a CallbackUrl (or ClusterCallbackUrl)...
+		if owner.APIVersion != apiGroupVersion || owner.Kind != kind {
+			return nil
 		}
-	}
 
-	return nil // TODO we shoudl return err too
+		// ...and if so, return it
+		return []string{owner.Name}
+	})
 }
 
-// findObjectsCallbackPayload is getting a []reconcile.Reqeust based on the LabelSelector of the Payload
-func (r *CallbackUrlReconciler) findObjectsCallbackPayload(payload client.Object) []reconcile.Request {
-	var urls erinnerungv1alpha1.CallbackUrlList
+// jobOwnerKeyFor returns the index key of the sender Jobs owned by the kind of callback.
+func jobOwnerKeyFor(callback v1alpha1.Callback) string {
+	if callback.GetNamespace() == "" {
+		return clusterJobOwnerKey
+	}
+	return jobOwnerKey
+}
 
-	// TODO is this enough of an sanity check?!
-	if r.CallbackUrl == nil {
-		return []reconcile.Request{}
+// jobNamespace returns the namespace of the sender Jobs: the CallbackUrl's namespace, or the SenderNamespace for
+// ClusterCallbackUrls.
+func (r *CallbackUrlReconciler) jobNamespace(callback v1alpha1.Callback) string {
+	if ns := callback.GetNamespace(); ns != "" {
+		return ns
 	}
+	return r.SenderNamespace
+}
 
-	// 1. get all CallbackURLs based on the LabelSelector
-	selector, _ := metav1.LabelSelectorAsSelector(&r.CallbackUrl.Spec.Selector) //TODO err handler
-	options := client.ListOptions{
-		LabelSelector: selector,
-		Raw:           &metav1.ListOptions{},
+// correlationKey returns the key of the CallbackPayload label copied to the sender Jobs, if any.
+func (r *CallbackUrlReconciler) correlationKey(callback v1alpha1.Callback) string {
+	if key := callback.CallbackSpec().CorrelationKey; key != "" {
+		return key
+	}
+	return r.CorrelationKey
+}
+
+// jobLabels returns the labels of the sender Job delivering the payload: the labels of the callback, the UIDs
+// correlating the Job with the payload and the callback, and the payload's correlation key label.
+func (r *CallbackUrlReconciler) jobLabels(callback v1alpha1.Callback, p *erinnerungv1alpha1.CallbackPayload) map[string]string {
+	labels := make(map[string]string, len(callback.GetLabels())+5)
+	for k, v := range callback.GetLabels() {
+		labels[k] = v
+	}
+	if key := r.correlationKey(callback); key != "" {
+		if value, ok := p.Labels[key]; ok {
+			labels[key] = value
+		}
 	}
+	labels[v1alpha1.PayloadUIDLabel] = string(p.UID)
+	labels[v1alpha1.CallbackUIDLabel] = string(callback.GetUID())
+	labels[v1alpha1.PayloadNameLabel] = labelValue(p.Name)
+	labels[v1alpha1.CallbackNameLabel] = labelValue(callback.GetName())
+
+	return labels
+}
 
-	if err := r.List(context.TODO(), &urls, client.InNamespace(payload.GetNamespace()), &options); err != nil {
-		// quietly return nothing and ignore the error
-		return []reconcile.Request{}
+// jobAnnotations returns the annotations of the sender Job delivering the payload.
+func (r *CallbackUrlReconciler) jobAnnotations(callback v1alpha1.Callback, p *erinnerungv1alpha1.CallbackPayload) map[string]string {
+	annotations := map[string]string{
+		v1alpha1.PayloadAnnotation:           p.Namespace + "/" + p.Name,
+		v1alpha1.PayloadGenerationAnnotation: strconv.FormatInt(deliveryGeneration(callback, p), 10),
+		v1alpha1.ContentHashAnnotation:       requestHash(renderRequest(p)),
+		v1alpha1.DeliveryIDAnnotation:        deliveryID(callback, p),
+		v1alpha1.CallbackAnnotation:          callback.GetName(),
+	}
+	if ns := callback.GetNamespace(); ns != "" {
+		annotations[v1alpha1.CallbackAnnotation] = ns + "/" + callback.GetName()
+	}
+	if key := r.correlationKey(callback); key != "" {
+		annotations[v1alpha1.CorrelationKeyAnnotation] = key
 	}
 
-	// 2. let's create the ist of reconcile.Requests{}
-	requests := make([]reconcile.Request, len(urls.Items))
-	for i, item := range urls.Items {
-		requests[i] = reconcile.Request{
-			NamespacedName: types.NamespacedName{
-				Name:      item.GetName(),
-				Namespace: item.GetNamespace(),
-			},
+	return annotations
+}
+
+// findPayloadForJob returns the payload delivered by the sender Job, correlated by the payload's UID.
+func (r *CallbackUrlReconciler) findPayloadForJob(payloads []erinnerungv1alpha1.CallbackPayload, job kbatch.Job) *erinnerungv1alpha1.CallbackPayload {
+	for i, p := range payloads {
+		if string(p.UID) == job.ObjectMeta.Labels[v1alpha1.PayloadUIDLabel] {
+			return &payloads[i]
 		}
 	}
 
-	// 3. return all the reconcile.Requests{}
-	return requests
+	return nil // TODO we shoudl return err too
+}
+
+// findObjectsCallbackPayload is getting a []reconcile.Request for all CallbackUrls whose LabelSelector matches the
+// payload: those of the payload's namespace, and those with a `namespaceSelector` allowed to receive it
+func (r *CallbackUrlReconciler) findObjectsCallbackPayload(payload client.Object) []reconcile.Request {
+	namespace := payload.GetNamespace()
+
+	return r.selectors.match(namespace, labels.Set(payload.GetLabels()), func(key types.NamespacedName) bool {
+		return r.CrossNamespace.Allows(key.Namespace, namespace)
+	})
 }
 
-// Force object status update. Returns a reconcile result
-func (r *CallbackUrlReconciler) UpdateStatusNow(ctx context.Context, originalErr error) (ctrl.Result, error) {
+// Force object status update, with the phase aggregated from the conditions set so far. Returns a reconcile result
+func (r *CallbackUrlReconciler) UpdateStatusNow(ctx context.Context, callback v1alpha1.Callback, originalErr error) (ctrl.Result, error) {
 	logger := log.FromContext(ctx)
 
-	if err := r.Status().Update(ctx, r.CallbackUrl); err != nil {
+	callback.CallbackStatus().Phase = callback.AggregatePhase()
+	if err := r.Status().Update(ctx, callback); err != nil {
 		logger.WithValues("reason", err.Error()).Info("Unable to update status, retrying")
 		return ctrl.Result{Requeue: true}, nil
 	}
@@ -323,9 +667,26 @@ func (r *CallbackUrlReconciler) UpdateStatusNow(ctx context.Context, originalErr
 	}
 }
 
+// conditionErrorOrRequeue reports a conditionError as False condition and updates the status, any other error is
+// logged and the reconciliation is requeued.
+func (r *CallbackUrlReconciler) conditionErrorOrRequeue(ctx context.Context, callback v1alpha1.Callback, err error, msg string) (ctrl.Result, error) {
+	var condErr *conditionError
+	if stderrors.As(err, &condErr) {
+		setCondition(callback, condErr.conditionType, metav1.ConditionFalse, condErr.reason, condErr.message)
+		result, err := r.UpdateStatusNow(ctx, callback, nil)
+		if condErr.requeue && err == nil && !result.Requeue {
+			result.RequeueAfter = RequeueAfter
+		}
+		return result, err
+	}
+
+	log.FromContext(ctx).Error(err, msg)
+	return r.UpdateStatusNow(ctx, callback, err)
+}
+
 // Set status condition helper
-func (r *CallbackUrlReconciler) SetCondition(conditionType string, status metav1.ConditionStatus, reason, message string) {
-	meta.SetStatusCondition(&r.CallbackUrl.Status.Conditions, metav1.Condition{
+func setCondition(callback v1alpha1.Callback, conditionType string, status metav1.ConditionStatus, reason, message string) {
+	meta.SetStatusCondition(&callback.CallbackStatus().Conditions, metav1.Condition{
 		Type:    conditionType,
 		Status:  status,
 		Reason:  reason,
@@ -333,34 +694,115 @@ func (r *CallbackUrlReconciler) SetCondition(conditionType string, status metav1
 	})
 }
 
-func (r *CallbackUrlReconciler) constructJob(p *erinnerungv1alpha1.CallbackPayload) (*kbatch.Job, error) {
-	// We want job names for a given nominal start time to have a deterministic name to avoid the same job being created twice
-	name := fmt.Sprintf("erinnerung-sender-%s-%s", r.CallbackUrl.ObjectMeta.Name, p.ObjectMeta.Name)
+// jobName returns the name of the sender Job of a delivery attempt. We want a deterministic name to avoid the same
+// attempt being created twice, and a short one as the name is also used as a label value (max. 63 characters).
+func jobName(callback v1alpha1.Callback, p *erinnerungv1alpha1.CallbackPayload, attempt int) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s/%s/%d", callback.GetUID(), p.UID, attempt)))
+
+	return "erinnerung-sender-" + hex.EncodeToString(sum[:])[:16]
+}
+
+// deliveryID returns the ID of the logical delivery of the payload's delivery generation to the callback. Unlike the name of
+// the sender Job it does not change with the attempt, so the receiver can tell a retry from a new callback.
+func deliveryID(callback v1alpha1.Callback, p *erinnerungv1alpha1.CallbackPayload) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s/%s/%d", callback.GetUID(), p.UID, deliveryGeneration(callback, p))))
+
+	return hex.EncodeToString(sum[:16])
+}
+
+// nextAttempt returns the attempt following the latest sender Job delivering the payload, the Jobs of earlier attempts
+// may have been deleted.
+func nextAttempt(jobs []kbatch.Job, p *erinnerungv1alpha1.CallbackPayload) int {
+	next := 0
+	for i := range jobs {
+		j := &jobs[i]
+		if j.Labels[v1alpha1.PayloadUIDLabel] == string(p.UID) && jobAttempt(j) >= next {
+			next = jobAttempt(j) + 1
+		}
+	}
+
+	return next
+}
+
+// nextDeliveryAttempt returns the attempt following the latest sender Job of the delivery, the attempts of a new
+// generation of the payload start at 1 again.
+func nextDeliveryAttempt(jobs []kbatch.Job, deliveryID string) int {
+	next := 1
+	for i := range jobs {
+		j := &jobs[i]
+		if j.Annotations[v1alpha1.DeliveryIDAnnotation] == deliveryID && jobDeliveryAttempt(j) >= next {
+			next = jobDeliveryAttempt(j) + 1
+		}
+	}
+
+	return next
+}
+
+// existingAttempt tells if the existing Job of the same name is the sender Job of the attempt, created by an earlier
+// reconcile the cache has not caught up with yet.
+func (r *CallbackUrlReconciler) existingAttempt(ctx context.Context, job *kbatch.Job) (bool, error) {
+	reader := r.APIReader
+	if reader == nil {
+		reader = r.Client
+	}
+
+	var existing kbatch.Job
+	if err := reader.Get(ctx, client.ObjectKeyFromObject(job), &existing); err != nil {
+		return false, err
+	}
+
+	return existing.Labels[v1alpha1.PayloadUIDLabel] == job.Labels[v1alpha1.PayloadUIDLabel] &&
+		existing.Labels[v1alpha1.AttemptLabel] == job.Labels[v1alpha1.AttemptLabel] &&
+		existing.Annotations[v1alpha1.DeliveryIDAnnotation] == job.Annotations[v1alpha1.DeliveryIDAnnotation], nil
+}
+
+// labelValue truncates a name to a valid label value.
+func labelValue(name string) string {
+	if len(name) <= validation.LabelValueMaxLength {
+		return name
+	}
+
+	return strings.TrimRight(name[:validation.LabelValueMaxLength], "-_.")
+}
+
+func (r *CallbackUrlReconciler) constructJob(callback v1alpha1.Callback, p *erinnerungv1alpha1.CallbackPayload, attempt int, targetURL, targetResolve string) (*kbatch.Job, error) {
+	labels := r.jobLabels(callback, p)
+	labels[v1alpha1.AttemptLabel] = strconv.Itoa(attempt)
+
+	template, err := r.senderPodTemplate(callback, []corev1.EnvVar{
+		{
+			Name:  "CALLBACK_URL",
+			Value: targetURL,
+		},
+		{
+			// the address checked against the EgressPolicy, empty for in-cluster Services
+			Name:  "CALLBACK_RESOLVE",
+			Value: targetResolve,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	// the sender pods are selected by the NetworkPolicy of the callback
+	if template.Labels == nil {
+		template.Labels = map[string]string{}
+	}
+	template.Labels[v1alpha1.CallbackUIDLabel] = string(callback.GetUID())
+	// the payload is passed in a Secret, not in the Job spec
+	name := jobName(callback, p, attempt)
+	mountRequestSecret(&template.Spec, name)
 
 	job := &kbatch.Job{
 		TypeMeta:   metav1.TypeMeta{},
-		ObjectMeta: metav1.ObjectMeta{Labels: r.CallbackUrl.ObjectMeta.Labels, Annotations: make(map[string]string), Name: name, Namespace: r.CallbackUrl.ObjectMeta.Namespace},
+		ObjectMeta: metav1.ObjectMeta{Labels: labels, Annotations: r.jobAnnotations(callback, p), Name: name, Namespace: r.jobNamespace(callback)},
 		Spec: kbatch.JobSpec{
-			Template: corev1.PodTemplateSpec{
-				ObjectMeta: metav1.ObjectMeta{},
-				Spec: corev1.PodSpec{
-					Containers: []corev1.Container{
-						{
-							Name:  "curl-sender",
-							Image: "registry.access.redhat.com/ubi9/ubi-minimal:9.0.0-1471",
-							Command: []string{
-								"sleep",
-								"180",
-							},
-						},
-					},
-					RestartPolicy: v1.RestartPolicyNever,
-				},
-			},
+			// the reconciler retries a failed delivery, honoring the backoff and the back-pressure of the receiver
+			BackoffLimit: pointer.Int32(0),
+			Template:     template,
 		},
 	}
 
-	if err := ctrl.SetControllerReference(r.CallbackUrl, job, r.Scheme); err != nil {
+	if err := ctrl.SetControllerReference(callback, job, r.Scheme); err != nil {
 		return nil, err
 	}
 
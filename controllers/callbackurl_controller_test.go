@@ -21,14 +21,20 @@ package controllers
 
 import (
 	"fmt"
+	"strings"
 	"time"
 
 	kbatch "k8s.io/api/batch/v1"
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/utils/pointer"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -125,6 +131,194 @@ var _ = Describe("CallbackUrl controller", func() {
 
 		})
 	})
+	Context("When creating a CallbackUrl with a correlationKey and one associated CallbackPayload", func() {
+		It("Should correlate the sender Job with the CallbackPayload", func() {
+			By("By creating a new CallbackUrl and CallbackPayload")
+			callbackUrl := generateCallbackUrl(testCallbackUrlName, testNamespace, "https://localhost.local:8181/webhook/xyz_callback")
+			callbackUrl.Spec.CorrelationKey = "adviser.thoth-station.ninja/adviser-id"
+			Expect(k8sClient.Create(ctx, callbackUrl)).Should(Succeed())
+			callbackPayload := generateCallbackPayload(testCallbackUrlName, testNamespace)
+			Expect(k8sClient.Create(ctx, callbackPayload)).Should(Succeed())
+
+			By("By checking the sender Job carries the payload's UID and correlation key label")
+			var jobs kbatch.JobList
+			Eventually(func() (int, error) {
+				err := k8sClient.List(ctx, &jobs, client.InNamespace(testNamespace), client.MatchingLabels{v1alpha1.PayloadUIDLabel: string(callbackPayload.UID)})
+				return len(jobs.Items), err
+			}, timeout, interval).Should(Equal(1))
+
+			job := jobs.Items[0]
+			Expect(job.Labels).To(HaveKeyWithValue(v1alpha1.CallbackUIDLabel, string(callbackUrl.UID)))
+			Expect(job.Labels).To(HaveKeyWithValue("adviser.thoth-station.ninja/adviser-id", testCallbackUrlName))
+			Expect(job.Annotations).To(HaveKeyWithValue(v1alpha1.PayloadAnnotation, testNamespace+"/"+callbackPayload.Name))
+
+			By("By checking the payload is passed in a request Secret owned by the Job")
+			secret := &v1.Secret{}
+			Eventually(func() (bool, error) {
+				if err := k8sClient.Get(ctx, types.NamespacedName{Name: job.Name, Namespace: testNamespace}, secret); err != nil {
+					return false, err
+				}
+				owner := metav1.GetControllerOf(secret)
+				return owner != nil && owner.UID == job.UID, nil
+			}, timeout, interval).Should(BeTrue())
+			Expect(string(secret.Data[requestBodyKey])).To(Equal(callbackPayload.Spec.Data))
+			Expect(string(secret.Data[requestHeadersKey])).To(ContainSubstring("Idempotency-Key: " + job.Annotations[v1alpha1.DeliveryIDAnnotation] + "\n"))
+			Expect(string(secret.Data[requestHeadersKey])).To(ContainSubstring("Erinnerung-Attempt: 1\n"))
+			secretNames := []string{}
+			for _, v := range job.Spec.Template.Spec.Volumes {
+				if v.Secret != nil {
+					secretNames = append(secretNames, v.Secret.SecretName)
+				}
+			}
+			Expect(secretNames).To(ConsistOf(job.Name))
+		})
+	})
+	Context("When deleting a CallbackPayload with an active delivery", func() {
+		It("Should cancel the delivery by deleting its sender Job", func() {
+			By("By creating a new CallbackUrl and CallbackPayload")
+			callbackUrl := generateCallbackUrl(testCallbackUrlName, testNamespace, "https://localhost.local:8181/webhook/xyz_callback")
+			Expect(k8sClient.Create(ctx, callbackUrl)).Should(Succeed())
+			callbackPayload := generateCallbackPayload(testCallbackUrlName, testNamespace)
+			Expect(k8sClient.Create(ctx, callbackPayload)).Should(Succeed())
+
+			var jobs kbatch.JobList
+			Eventually(func() (int, error) {
+				err := k8sClient.List(ctx, &jobs, client.InNamespace(testNamespace), client.MatchingLabels{v1alpha1.PayloadUIDLabel: string(callbackPayload.UID)})
+				return len(jobs.Items), err
+			}, timeout, interval).Should(Equal(1))
+
+			By("By deleting the CallbackPayload")
+			Eventually(func() (bool, error) {
+				err := k8sClient.Get(ctx, types.NamespacedName{Name: callbackPayload.Name, Namespace: testNamespace}, callbackPayload)
+				return controllerutil.ContainsFinalizer(callbackPayload, v1alpha1.CancelDeliveriesFinalizer), err
+			}, timeout, interval).Should(BeTrue())
+			Expect(k8sClient.Delete(ctx, callbackPayload)).Should(Succeed())
+
+			By("By checking the sender Job is being deleted, and the CallbackPayload is gone")
+			Eventually(func() bool {
+				job := &kbatch.Job{}
+				err := k8sClient.Get(ctx, client.ObjectKeyFromObject(&jobs.Items[0]), job)
+				// there is no garbage collector in the envtest, the foreground deletion does not finish
+				return errors.IsNotFound(err) || (err == nil && !job.DeletionTimestamp.IsZero())
+			}, timeout, interval).Should(BeTrue())
+			Eventually(func() bool {
+				err := k8sClient.Get(ctx, types.NamespacedName{Name: callbackPayload.Name, Namespace: testNamespace}, callbackPayload)
+				return errors.IsNotFound(err)
+			}, timeout, interval).Should(BeTrue())
+		})
+	})
+	Context("When creating a CallbackUrl referencing a Service that does not exist", func() {
+		It("Should have a ServiceAvailable Condition set to False", func() {
+			By("By creating a new CallbackUrl with a serviceRef")
+			callbackUrl := generateCallbackUrl(testCallbackUrlName, testNamespace, "")
+			callbackUrl.Spec.ServiceRef = &v1alpha1.ServiceReference{Name: "missing-receiver", Port: 8080, Path: "/callback"}
+			Expect(k8sClient.Create(ctx, callbackUrl)).Should(Succeed())
+
+			By("By checking the CallbackUrl has a ServiceAvailable Condition set to False")
+			lookupKey := types.NamespacedName{Name: testCallbackUrlName, Namespace: testNamespace}
+			Eventually(func() (bool, error) {
+				err := k8sClient.Get(ctx, lookupKey, callbackUrl)
+				if err != nil {
+					return false, err
+				}
+				return meta.IsStatusConditionFalse(callbackUrl.Status.Conditions, v1alpha1.ServiceAvailable), nil
+			}, timeout, interval).Should(BeTrue())
+
+			Expect(callbackUrl.Status.Phase).To(Equal(v1alpha1.PhaseFailed))
+		})
+	})
+
+	Context("When creating a CallbackUrl with a namespaceSelector and cross-namespace matching disabled", func() {
+		It("Should have a CrossNamespaceAllowed Condition set to False", func() {
+			By("By creating a new CallbackUrl with a namespaceSelector")
+			callbackUrl := generateCallbackUrl(testCallbackUrlName, testNamespace, "https://localhost.local:8181/webhook/xyz_callback")
+			callbackUrl.Spec.NamespaceSelector = &metav1.LabelSelector{}
+			Expect(k8sClient.Create(ctx, callbackUrl)).Should(Succeed())
+
+			By("By checking the CallbackUrl has a CrossNamespaceAllowed Condition set to False")
+			lookupKey := types.NamespacedName{Name: testCallbackUrlName, Namespace: testNamespace}
+			Eventually(func() (bool, error) {
+				err := k8sClient.Get(ctx, lookupKey, callbackUrl)
+				if err != nil {
+					return false, err
+				}
+				return meta.IsStatusConditionFalse(callbackUrl.Status.Conditions, v1alpha1.CrossNamespaceAllowed), nil
+			}, timeout, interval).Should(BeTrue())
+		})
+	})
+
+	Context("When creating a CallbackUrl whose receiver does not echo the verification challenge", func() {
+		It("Should keep its payloads and suspend it", func() {
+			By("By creating a new CallbackUrl requiring a verification and a CallbackPayload")
+			callbackUrl := generateCallbackUrl(testCallbackUrlName, testNamespace, "https://localhost.local:8181/webhook/xyz_callback")
+			callbackUrl.Spec.Verification = &v1alpha1.VerificationSpec{SuspendAfter: &metav1.Duration{}}
+			Expect(k8sClient.Create(ctx, callbackUrl)).Should(Succeed())
+			callbackPayload := generateCallbackPayload(testCallbackUrlName, testNamespace)
+			Expect(k8sClient.Create(ctx, callbackPayload)).Should(Succeed())
+
+			By("By checking the CallbackUrl is suspended as its verification failed")
+			lookupKey := types.NamespacedName{Name: testCallbackUrlName, Namespace: testNamespace}
+			Eventually(func() (bool, error) {
+				err := k8sClient.Get(ctx, lookupKey, callbackUrl)
+				if err != nil {
+					return false, err
+				}
+				return callbackUrl.Spec.Suspend && meta.IsStatusConditionFalse(callbackUrl.Status.Conditions, v1alpha1.Verified), nil
+			}, timeout, interval).Should(BeTrue())
+			Expect(meta.FindStatusCondition(callbackUrl.Status.Conditions, v1alpha1.Suspended).Reason).To(Equal("VerificationFailed"))
+
+			By("By checking the CallbackPayload has not been delivered")
+			var jobs kbatch.JobList
+			Expect(k8sClient.List(ctx, &jobs, client.InNamespace(testNamespace), client.MatchingLabels{v1alpha1.PayloadUIDLabel: string(callbackPayload.UID)})).To(Succeed())
+			Expect(jobs.Items).To(BeEmpty())
+		})
+	})
+})
+
+var _ = Describe("Sender Job naming", func() {
+	It("Should generate deterministic, length-safe names per delivery attempt", func() {
+		callbackUrl := generateCallbackUrl(strings.Repeat("a", 200), "default", "https://localhost.local:8181/webhook/xyz_callback")
+		callbackUrl.UID = "0a1b2c3d"
+		callbackPayload := generateCallbackPayload(strings.Repeat("b", 200), "default")
+		callbackPayload.UID = "4e5f6a7b"
+
+		name := jobName(callbackUrl, callbackPayload, 0)
+		Expect(len(name)).To(BeNumerically("<=", validation.DNS1123LabelMaxLength))
+		Expect(jobName(callbackUrl, callbackPayload, 0)).To(Equal(name))
+		Expect(jobName(callbackUrl, callbackPayload, 1)).NotTo(Equal(name))
+
+		Expect(validation.IsValidLabelValue(labelValue(callbackUrl.Name))).To(BeEmpty())
+	})
+
+	It("Should continue after the latest attempt, if earlier Jobs are gone", func() {
+		callbackPayload := generateCallbackPayload("abc123", "default")
+		callbackPayload.UID = "4e5f6a7b"
+		attemptJob := func(payloadUID string, attempt string) kbatch.Job {
+			return kbatch.Job{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{
+				v1alpha1.PayloadUIDLabel: payloadUID,
+				v1alpha1.AttemptLabel:    attempt,
+			}}}
+		}
+
+		Expect(nextAttempt(nil, callbackPayload)).To(Equal(0))
+		// the Jobs of the attempts 0 and 1 have been deleted
+		jobs := []kbatch.Job{attemptJob("4e5f6a7b", "2"), attemptJob("4e5f6a7b", "3"), attemptJob("8c9d0e1f", "7")}
+		Expect(nextAttempt(jobs, callbackPayload)).To(Equal(4))
+	})
+
+	It("Should leave the retries of a failed delivery to the reconciler", func() {
+		s := runtime.NewScheme()
+		Expect(v1alpha1.AddToScheme(s)).To(Succeed())
+		r := &CallbackUrlReconciler{Scheme: s}
+		callbackUrl := generateCallbackUrl("abc123", "default", "https://localhost.local:8181/webhook/xyz_callback")
+		callbackUrl.UID = "0a1b2c3d"
+		callbackPayload := generateCallbackPayload("abc123", "default")
+		callbackPayload.UID = "4e5f6a7b"
+
+		job, err := r.constructJob(callbackUrl, callbackPayload, 0, callbackUrl.Spec.URL, "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(job.Spec.BackoffLimit).To(Equal(pointer.Int32(0)))
+	})
 })
 
 func generateCallbackUrl(adviserId string, namespace string, url string) *v1alpha1.CallbackUrl {
@@ -0,0 +1,83 @@
+/*
+Copyright (C) 2022 Christoph Görn
+
+This file is part of r-gespraech.
+
+r-gespraech is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+r-gespraech is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with r-gespraech.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	erinnerungv1alpha1 "github.com/goern/r-gespraech/api/v1alpha1"
+)
+
+// payloadNamespaces returns the namespaces a CallbackUrl receives CallbackPayloads from: its own namespace, or the
+// namespaces selected by its `namespaceSelector` and allowed by the CrossNamespacePolicy. A ClusterCallbackUrl
+// receives CallbackPayloads from all namespaces (""), or the namespaces selected by its `namespaceSelector`.
+func (r *CallbackUrlReconciler) payloadNamespaces(ctx context.Context, u erinnerungv1alpha1.Callback) ([]string, error) {
+	clusterScoped := u.GetNamespace() == ""
+	spec := u.CallbackSpec()
+
+	if spec.NamespaceSelector == nil {
+		return []string{u.GetNamespace()}, nil
+	}
+
+	// the manager-role is bound by RoleBindings, which can not grant access to the namespaces
+	if r.Namespaced {
+		return nil, &conditionError{
+			conditionType: erinnerungv1alpha1.CrossNamespaceAllowed,
+			reason:        "NamespaceSelectorUnsupported",
+			message:       "the namespaceSelector is set, but the operator is restricted to namespaces",
+		}
+	}
+
+	if !clusterScoped && (r.CrossNamespace == nil || !r.CrossNamespace.Enabled) {
+		return nil, &conditionError{
+			conditionType: erinnerungv1alpha1.CrossNamespaceAllowed,
+			reason:        "CrossNamespaceDisabled",
+			message:       "the namespaceSelector is set, but cross-namespace matching is not enabled",
+		}
+	}
+
+	selector, err := metav1.LabelSelectorAsSelector(spec.NamespaceSelector)
+	if err != nil {
+		return nil, &conditionError{
+			conditionType: erinnerungv1alpha1.CrossNamespaceAllowed,
+			reason:        "InvalidNamespaceSelector",
+			message:       fmt.Sprintf("the namespaceSelector is invalid: %v", err),
+		}
+	}
+
+	var namespaces corev1.NamespaceList
+	if err := r.List(ctx, &namespaces, client.MatchingLabelsSelector{Selector: selector}); err != nil {
+		return nil, err
+	}
+
+	result := []string{}
+	for _, ns := range namespaces.Items {
+		if clusterScoped || r.CrossNamespace.Allows(u.GetNamespace(), ns.Name) {
+			result = append(result, ns.Name)
+		}
+	}
+
+	return result, nil
+}
@@ -0,0 +1,150 @@
+/*
+Copyright (C) 2022 Christoph Görn
+
+This file is part of r-gespraech.
+
+r-gespraech is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+r-gespraech is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with r-gespraech.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	erinnerungv1alpha1 "github.com/goern/r-gespraech/api/v1alpha1"
+)
+
+const (
+	serviceRefKey = ".spec.serviceRef"
+)
+
+// serviceRefNamespace returns the namespace of the referenced Service, defaulting to the CallbackUrl's namespace.
+func serviceRefNamespace(ref *erinnerungv1alpha1.ServiceReference, defaultNamespace string) string {
+	if ref.Namespace != "" {
+		return ref.Namespace
+	}
+	return defaultNamespace
+}
+
+// serviceRefIndexValue is the value of the serviceRefKey index for a CallbackUrl.
+func serviceRefIndexValue(namespace, name string) string {
+	return types.NamespacedName{Namespace: namespace, Name: name}.String()
+}
+
+// resolveServiceRef is turning a ServiceReference into the URL to call back, and tells if the URL points into the
+// cluster. It returns a conditionError if the Service, the referenced port or any ready endpoint is missing.
+func (r *CallbackUrlReconciler) resolveServiceRef(ctx context.Context, ref *erinnerungv1alpha1.ServiceReference, defaultNamespace string) (string, bool, error) {
+	key := types.NamespacedName{Name: ref.Name, Namespace: serviceRefNamespace(ref, defaultNamespace)}
+
+	var svc corev1.Service
+	if err := r.Get(ctx, key, &svc); err != nil {
+		if errors.IsNotFound(err) {
+			return "", false, newServiceUnavailable("ServiceNotFound", fmt.Sprintf("the Service %v does not exist", key))
+		}
+		return "", false, err
+	}
+
+	hasPort := false
+	for _, p := range svc.Spec.Ports {
+		if p.Port == ref.Port {
+			hasPort = true
+			break
+		}
+	}
+	if !hasPort {
+		return "", false, newServiceUnavailable("ServicePortNotFound", fmt.Sprintf("the Service %v has no port %d", key, ref.Port))
+	}
+
+	scheme := ref.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+	path := ref.Path
+	if path == "" {
+		path = "/"
+	}
+
+	// ExternalName Services have no endpoints and point out of the cluster, so they are subject to the EgressPolicy
+	if svc.Spec.Type == corev1.ServiceTypeExternalName {
+		u := url.URL{
+			Scheme: scheme,
+			Host:   net.JoinHostPort(svc.Spec.ExternalName, strconv.Itoa(int(ref.Port))),
+			Path:   path,
+		}
+		return u.String(), false, nil
+	}
+
+	var endpoints corev1.Endpoints
+	if err := r.Get(ctx, key, &endpoints); err != nil {
+		if errors.IsNotFound(err) {
+			return "", false, newServiceUnavailable("EndpointsNotFound", fmt.Sprintf("the Service %v has no endpoints", key))
+		}
+		return "", false, err
+	}
+
+	ready := false
+	for _, s := range endpoints.Subsets {
+		if len(s.Addresses) > 0 {
+			ready = true
+			break
+		}
+	}
+	if !ready {
+		return "", false, newServiceUnavailable("NoReadyEndpoints", fmt.Sprintf("the Service %v has no ready endpoints", key))
+	}
+
+	u := url.URL{
+		Scheme: scheme,
+		Host:   net.JoinHostPort(fmt.Sprintf("%s.%s.svc", key.Name, key.Namespace), strconv.Itoa(int(ref.Port))),
+		Path:   path,
+	}
+
+	return u.String(), true, nil
+}
+
+func newServiceUnavailable(reason, message string) *conditionError {
+	return &conditionError{conditionType: erinnerungv1alpha1.ServiceAvailable, reason: reason, message: message}
+}
+
+// findObjectsForService is getting a []reconcile.Request for all CallbackUrls referencing a Service (or its Endpoints)
+func (r *CallbackUrlReconciler) findObjectsForService(obj client.Object) []reconcile.Request {
+	var urls erinnerungv1alpha1.CallbackUrlList
+
+	if err := r.List(context.TODO(), &urls, client.MatchingFields{serviceRefKey: serviceRefIndexValue(obj.GetNamespace(), obj.GetName())}); err != nil {
+		// quietly return nothing and ignore the error
+		return []reconcile.Request{}
+	}
+
+	requests := make([]reconcile.Request, len(urls.Items))
+	for i, item := range urls.Items {
+		requests[i] = reconcile.Request{
+			NamespacedName: types.NamespacedName{
+				Name:      item.GetName(),
+				Namespace: item.GetNamespace(),
+			},
+		}
+	}
+
+	return requests
+}
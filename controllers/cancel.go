@@ -0,0 +1,76 @@
+/*
+Copyright (C) 2022 Christoph Görn
+
+This file is part of r-gespraech.
+
+r-gespraech is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+r-gespraech is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with r-gespraech.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	kbatch "k8s.io/api/batch/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	erinnerungv1alpha1 "github.com/goern/r-gespraech/api/v1alpha1"
+)
+
+// cancelDeliveries deletes the unfinished sender Jobs, with foreground propagation so their pods are gone before
+// the Jobs are. The finished Jobs are left to the garbage collector.
+func cancelDeliveries(ctx context.Context, c client.Client, jobs []kbatch.Job) error {
+	logger := log.FromContext(ctx)
+
+	for i := range jobs {
+		j := &jobs[i]
+		if finished, _ := jobFinished(j); finished || !j.DeletionTimestamp.IsZero() {
+			continue
+		}
+
+		logger.Info("cancelling delivery", "job", j.Name)
+		if err := c.Delete(ctx, j, client.PropagationPolicy(metav1.DeletePropagationForeground)); client.IgnoreNotFound(err) != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// finalize cancels the deliveries of a deleted object and removes its finalizer, it returns true if obj is being
+// deleted. Objects not being deleted get the finalizer added. The finalizer is patched, so an object that no longer
+// passes the validating webhook is still deleted.
+func finalize(ctx context.Context, c client.Client, obj client.Object, cancel func() error) (bool, error) {
+	patch := client.MergeFrom(obj.DeepCopyObject().(client.Object))
+	if obj.GetDeletionTimestamp().IsZero() {
+		if !controllerutil.ContainsFinalizer(obj, erinnerungv1alpha1.CancelDeliveriesFinalizer) {
+			controllerutil.AddFinalizer(obj, erinnerungv1alpha1.CancelDeliveriesFinalizer)
+			return false, c.Patch(ctx, obj, patch)
+		}
+		return false, nil
+	}
+
+	if !controllerutil.ContainsFinalizer(obj, erinnerungv1alpha1.CancelDeliveriesFinalizer) {
+		return true, nil
+	}
+	if err := cancel(); err != nil {
+		return true, err
+	}
+	controllerutil.RemoveFinalizer(obj, erinnerungv1alpha1.CancelDeliveriesFinalizer)
+
+	return true, c.Patch(ctx, obj, patch)
+}
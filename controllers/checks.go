@@ -0,0 +1,162 @@
+/*
+Copyright (C) 2022 Christoph Görn
+
+This file is part of r-gespraech.
+
+r-gespraech is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+r-gespraech is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with r-gespraech.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package controllers
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+
+	erinnerungv1alpha1 "github.com/goern/r-gespraech/api/v1alpha1"
+)
+
+// checkKind tells the probe of a callback target from the verification of its receiver.
+type checkKind string
+
+const (
+	probeCheck        checkKind = "probe"
+	verificationCheck checkKind = "verification"
+)
+
+// checkResult is the result of a probe or a verification, recorded in the status of the callback by the reconcile
+// following it.
+type checkResult struct {
+	// started is the time the check started, recorded as the time of the latest check
+	started metav1.Time
+	status  metav1.ConditionStatus
+	reason  string
+	message string
+	// latency is the time the target took to respond, if it did
+	latency *metav1.Duration
+	// target is the URL of the checked target
+	target string
+}
+
+// checkKey identifies the check of a callback.
+type checkKey struct {
+	uid  types.UID
+	kind checkKind
+}
+
+// runningCheck is a check running in the background.
+type runningCheck struct {
+	cancel context.CancelFunc
+}
+
+// targetChecks runs the probes and verifications of the callback targets in the background, so a slow target does
+// not hold up a reconcile worker. Once a check has finished, the callback is reconciled to record its result.
+type targetChecks struct {
+	mu      sync.Mutex
+	running map[checkKey]*runningCheck
+	results map[checkKey]checkResult
+
+	// finished receives the callbacks whose check has finished, it is the source of a watch of the controller
+	finished chan event.GenericEvent
+}
+
+func newTargetChecks() *targetChecks {
+	return &targetChecks{
+		running:  map[checkKey]*runningCheck{},
+		results:  map[checkKey]checkResult{},
+		finished: make(chan event.GenericEvent),
+	}
+}
+
+// start runs the check of the callback in the background, unless it is running already. The check is cancelled
+// after the timeout.
+func (c *targetChecks) start(ctx context.Context, callback erinnerungv1alpha1.Callback, kind checkKind, timeout time.Duration, check func(context.Context) checkResult) {
+	key := checkKey{uid: callback.GetUID(), kind: kind}
+	// the copy tells the name of the callback to reconcile
+	obj := callback.DeepCopyObject().(client.Object)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.running[key]; ok {
+		return
+	}
+	checkCtx, cancel := context.WithTimeout(ctx, timeout)
+	rc := &runningCheck{cancel: cancel}
+	c.running[key] = rc
+
+	go func() {
+		defer cancel()
+		result := check(checkCtx)
+
+		c.mu.Lock()
+		current := c.running[key] == rc
+		if current {
+			delete(c.running, key)
+			c.results[key] = result
+		}
+		c.mu.Unlock()
+		if !current {
+			return
+		}
+
+		select {
+		case c.finished <- event.GenericEvent{Object: obj}:
+		case <-ctx.Done():
+		}
+	}()
+}
+
+// isRunning tells if the check of the callback is running.
+func (c *targetChecks) isRunning(uid types.UID, kind checkKind) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, ok := c.running[checkKey{uid: uid, kind: kind}]
+	return ok
+}
+
+// result returns the result of the finished check of the callback, if it has not been returned before.
+func (c *targetChecks) result(uid types.UID, kind checkKind) (checkResult, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := checkKey{uid: uid, kind: kind}
+	result, ok := c.results[key]
+	delete(c.results, key)
+	return result, ok
+}
+
+// cancel cancels the running checks of a deleted callback and drops their results.
+func (c *targetChecks) cancel(uid types.UID) {
+	c.stop(uid, probeCheck)
+	c.stop(uid, verificationCheck)
+}
+
+// stop cancels the running check of the callback and drops its result.
+func (c *targetChecks) stop(uid types.UID, kind checkKind) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := checkKey{uid: uid, kind: kind}
+	if rc, ok := c.running[key]; ok {
+		rc.cancel()
+		delete(c.running, key)
+	}
+	delete(c.results, key)
+}
@@ -0,0 +1,134 @@
+/*
+Copyright (C) 2022 Christoph Görn
+
+This file is part of r-gespraech.
+
+r-gespraech is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+r-gespraech is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with r-gespraech.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	kbatch "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	erinnerungv1alpha1 "github.com/goern/r-gespraech/api/v1alpha1"
+)
+
+// ClusterCallbackUrlReconciler reconciles a ClusterCallbackUrl object, using the delivery machinery of the
+// CallbackUrlReconciler. The sender Jobs are created in the SenderNamespace.
+type ClusterCallbackUrlReconciler struct {
+	CallbackUrlReconciler
+}
+
+//+kubebuilder:rbac:groups=erinnerung.thoth-station.ninja,resources=clustercallbackurls,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=erinnerung.thoth-station.ninja,resources=clustercallbackurls/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=erinnerung.thoth-station.ninja,resources=clustercallbackurls/finalizers,verbs=update
+
+// Reconcile is part of the main kubernetes reconciliation loop which aims to
+// move the current state of the cluster closer to the desired state.
+func (r *ClusterCallbackUrlReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	callback := &erinnerungv1alpha1.ClusterCallbackUrl{}
+	result, err := r.reconcileCallback(ctx, req, callback)
+
+	return r.requeueChecks(callback, result), err
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *ClusterCallbackUrlReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	if err := indexJobOwner(mgr, clusterJobOwnerKey, "ClusterCallbackUrl"); err != nil {
+		return err
+	}
+
+	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &erinnerungv1alpha1.ClusterCallbackUrl{}, serviceRefKey, func(rawObj client.Object) []string {
+		// grab the ClusterCallbackUrl object, extract the Service reference...
+		u := rawObj.(*erinnerungv1alpha1.ClusterCallbackUrl)
+		if u.Spec.ServiceRef == nil {
+			return nil
+		}
+
+		// ...and return it
+		return []string{serviceRefIndexValue(serviceRefNamespace(u.Spec.ServiceRef, r.SenderNamespace), u.Spec.ServiceRef.Name)}
+	}); err != nil {
+		return err
+	}
+
+	r.selectors = newSelectorIndex()
+	if err := r.selectors.watch(mgr, &erinnerungv1alpha1.ClusterCallbackUrl{}); err != nil {
+		return err
+	}
+	r.checks = newTargetChecks()
+
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&erinnerungv1alpha1.ClusterCallbackUrl{}).
+		WithOptions(controller.Options{MaxConcurrentReconciles: r.MaxConcurrentReconciles}).
+		Owns(&kbatch.Job{}).
+		Owns(&networkingv1.NetworkPolicy{}).
+		Watches(
+			&source.Kind{Type: &erinnerungv1alpha1.CallbackPayload{}},
+			handler.EnqueueRequestsFromMapFunc(r.findObjectsCallbackPayload),
+			builder.WithPredicates(predicate.ResourceVersionChangedPredicate{}),
+		).
+		Watches(
+			&source.Kind{Type: &corev1.Service{}},
+			handler.EnqueueRequestsFromMapFunc(r.findObjectsForService),
+		).
+		Watches(
+			&source.Kind{Type: &corev1.Endpoints{}},
+			handler.EnqueueRequestsFromMapFunc(r.findObjectsForService),
+		).
+		Watches(
+			&source.Channel{Source: r.checks.finished},
+			&handler.EnqueueRequestForObject{},
+		).
+		Complete(r)
+}
+
+// findObjectsCallbackPayload is getting a []reconcile.Request for all ClusterCallbackUrls selecting the payload
+func (r *ClusterCallbackUrlReconciler) findObjectsCallbackPayload(payload client.Object) []reconcile.Request {
+	return r.selectors.match(payload.GetNamespace(), labels.Set(payload.GetLabels()), nil)
+}
+
+// findObjectsForService is getting a []reconcile.Request for all ClusterCallbackUrls referencing a Service (or its
+// Endpoints)
+func (r *ClusterCallbackUrlReconciler) findObjectsForService(obj client.Object) []reconcile.Request {
+	var urls erinnerungv1alpha1.ClusterCallbackUrlList
+
+	if err := r.List(context.TODO(), &urls, client.MatchingFields{serviceRefKey: serviceRefIndexValue(obj.GetNamespace(), obj.GetName())}); err != nil {
+		// quietly return nothing and ignore the error
+		return []reconcile.Request{}
+	}
+
+	requests := make([]reconcile.Request, len(urls.Items))
+	for i, item := range urls.Items {
+		requests[i] = reconcile.Request{
+			NamespacedName: types.NamespacedName{Name: item.GetName()},
+		}
+	}
+
+	return requests
+}
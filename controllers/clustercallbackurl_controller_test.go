@@ -0,0 +1,83 @@
+/*
+Copyright (C) 2022 Christoph Görn
+
+This file is part of r-gespraech.
+
+r-gespraech is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+r-gespraech is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with r-gespraech.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package controllers
+
+import (
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/goern/r-gespraech/api/v1alpha1"
+)
+
+var _ = Describe("ClusterCallbackUrl controller", func() {
+	var (
+		testNamespace              string
+		testClusterCallbackUrlName string
+		testAdviserId              string
+	)
+	const (
+		timeout  = time.Second * 10
+		interval = time.Millisecond * 250
+	)
+
+	BeforeEach(func() {
+		testNamespace = "test-" + String(6)
+		testClusterCallbackUrlName = "test-" + String(6)
+		testAdviserId = String(6)
+		nsSpec := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: testNamespace}}
+		Expect(k8sClient.Create(ctx, nsSpec)).Should(Succeed())
+	})
+
+	Context("When creating a ClusterCallbackUrl and a CallbackPayload in some namespace", func() {
+		It("Should have AssociatedPayloads Condition", func() {
+			By("By creating a new ClusterCallbackUrl")
+			labels := map[string]string{"adviser.thoth-station.ninja/adviser-id": testAdviserId}
+			clusterCallbackUrl := &v1alpha1.ClusterCallbackUrl{
+				TypeMeta:   metav1.TypeMeta{APIVersion: "erinnerung.thoth-station.ninja/v1alpha1", Kind: "ClusterCallbackUrl"},
+				ObjectMeta: metav1.ObjectMeta{Name: testClusterCallbackUrlName},
+				Spec: v1alpha1.CallbackUrlSpec{
+					URL:      "https://localhost.local:8181/webhook/audit",
+					Selector: metav1.LabelSelector{MatchLabels: labels},
+				},
+			}
+			Expect(k8sClient.Create(ctx, clusterCallbackUrl)).Should(Succeed())
+
+			By("By creating a new CallbackPayload")
+			Expect(k8sClient.Create(ctx, generateCallbackPayload(testAdviserId, testNamespace))).Should(Succeed())
+
+			By("By checking the ClusterCallbackUrl has an AssociatedPayloads Condition set to True")
+			lookupKey := types.NamespacedName{Name: testClusterCallbackUrlName}
+			Eventually(func() (bool, error) {
+				err := k8sClient.Get(ctx, lookupKey, clusterCallbackUrl)
+				if err != nil {
+					return false, err
+				}
+				return meta.IsStatusConditionTrue(clusterCallbackUrl.Status.Conditions, v1alpha1.AssociatedPayloads), nil
+			}, timeout, interval).Should(BeTrue())
+		})
+	})
+})
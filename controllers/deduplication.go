@@ -0,0 +1,82 @@
+/*
+Copyright (C) 2022 Christoph Görn
+
+This file is part of r-gespraech.
+
+r-gespraech is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+r-gespraech is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with r-gespraech.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package controllers
+
+import (
+	"context"
+	"time"
+
+	erinnerungv1alpha1 "github.com/goern/r-gespraech/api/v1alpha1"
+)
+
+// findDuplicate returns the payload delivered successfully to the callback with the content hash within the window,
+// and its delivery.
+func findDuplicate(callback erinnerungv1alpha1.Callback, p *erinnerungv1alpha1.CallbackPayload, hash string, window time.Duration, payloads []erinnerungv1alpha1.CallbackPayload) (*erinnerungv1alpha1.CallbackPayload, *erinnerungv1alpha1.CallbackPayloadDelivery) {
+	since := time.Now().Add(-window)
+
+	for i := range payloads {
+		other := &payloads[i]
+		if other.UID == p.UID {
+			continue
+		}
+		d := other.FindDelivery(callback.GetUID())
+		if d == nil || d.Phase != erinnerungv1alpha1.CallbackPayloadComplete || d.ContentHash != hash {
+			continue
+		}
+		if d.LastTransitionTime.Time.Before(since) {
+			continue
+		}
+		return other, d
+	}
+
+	return nil, nil
+}
+
+// deduplicate marks the payload as Deduplicated if a payload with the same rendered request has been delivered to
+// the callback within its deduplicationWindow. It returns true if the payload is a duplicate.
+func (r *CallbackUrlReconciler) deduplicate(ctx context.Context, callback erinnerungv1alpha1.Callback, p *erinnerungv1alpha1.CallbackPayload, payloads []erinnerungv1alpha1.CallbackPayload) (bool, error) {
+	window := callback.CallbackSpec().DeduplicationWindow
+	if window == nil || window.Duration <= 0 {
+		return false, nil
+	}
+
+	hash := requestHash(renderRequest(p))
+	original, _ := findDuplicate(callback, p, hash, window.Duration, payloads)
+	if original == nil {
+		return false, nil
+	}
+
+	delivery := erinnerungv1alpha1.CallbackPayloadDelivery{
+		Callback:           callbackReference(callback),
+		CallbackUID:        callback.GetUID(),
+		Phase:              erinnerungv1alpha1.CallbackPayloadDeduplicated,
+		ObservedGeneration: p.Generation,
+		ContentHash:        hash,
+		DuplicateOf:        original.Namespace + "/" + original.Name,
+	}
+	if p.SetDelivery(delivery) {
+		setDeliveryConditions(p)
+		if err := r.Status().Update(ctx, p); err != nil {
+			return true, err
+		}
+	}
+
+	return true, nil
+}
@@ -0,0 +1,355 @@
+/*
+Copyright (C) 2022 Christoph Görn
+
+This file is part of r-gespraech.
+
+r-gespraech is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+r-gespraech is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with r-gespraech.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	kbatch "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	erinnerungv1alpha1 "github.com/goern/r-gespraech/api/v1alpha1"
+)
+
+const (
+	// maxResponseLength is the length the receiver's response is truncated to in the delivery status.
+	maxResponseLength = 256
+	// maxConditionMessageLength is the maximum length of the message of a condition.
+	maxConditionMessageLength = 32768
+)
+
+// senderResult is the JSON summary of the HTTP result the sender writes as its termination message.
+type senderResult struct {
+	HTTPStatus int32  `json:"httpStatus,omitempty"`
+	ErrorClass string `json:"errorClass,omitempty"`
+	Response   string `json:"response,omitempty"`
+	// RetryAfter is the Retry-After header of the response, if any.
+	RetryAfter string `json:"retryAfter,omitempty"`
+}
+
+// jobFinished tells if the sender Job has finished, and if so if it failed.
+func jobFinished(job *kbatch.Job) (bool, bool) {
+	for _, c := range job.Status.Conditions {
+		if (c.Type == kbatch.JobComplete || c.Type == kbatch.JobFailed) && c.Status == corev1.ConditionTrue {
+			return true, c.Type == kbatch.JobFailed
+		}
+	}
+
+	return false, false
+}
+
+// jobAttempt returns the delivery attempt of the sender Job.
+func jobAttempt(job *kbatch.Job) int {
+	attempt, _ := strconv.Atoi(job.Labels[erinnerungv1alpha1.AttemptLabel])
+	return attempt
+}
+
+// jobDeliveryAttempt returns the attempt of the logical delivery of the sender Job, or 0 if it is unknown.
+func jobDeliveryAttempt(job *kbatch.Job) int {
+	attempt, _ := strconv.Atoi(job.Annotations[erinnerungv1alpha1.DeliveryAttemptAnnotation])
+	return attempt
+}
+
+// jobPayloadGeneration returns the generation of the CallbackPayload delivered by the sender Job.
+func jobPayloadGeneration(job *kbatch.Job) int64 {
+	generation, _ := strconv.ParseInt(job.Annotations[erinnerungv1alpha1.PayloadGenerationAnnotation], 10, 64)
+	return generation
+}
+
+// latestSenderJobs returns the sender Jobs of the latest attempt, and of the latest complete attempt, by payload UID.
+func latestSenderJobs(jobs []kbatch.Job) (map[string]*kbatch.Job, map[string]*kbatch.Job) {
+	latest := map[string]*kbatch.Job{}
+	latestComplete := map[string]*kbatch.Job{}
+
+	for i := range jobs {
+		j := &jobs[i]
+		uid := j.Labels[erinnerungv1alpha1.PayloadUIDLabel]
+		if l, ok := latest[uid]; !ok || jobAttempt(l) < jobAttempt(j) {
+			latest[uid] = j
+		}
+		if finished, failed := jobFinished(j); finished && !failed {
+			if l, ok := latestComplete[uid]; !ok || jobAttempt(l) < jobAttempt(j) {
+				latestComplete[uid] = j
+			}
+		}
+	}
+
+	return latest, latestComplete
+}
+
+// onUpdate returns the OnUpdate policy of the callback.
+func (r *CallbackUrlReconciler) onUpdate(callback erinnerungv1alpha1.Callback) string {
+	if policy := callback.CallbackSpec().OnUpdate; policy != "" {
+		return policy
+	}
+	return erinnerungv1alpha1.OnUpdateIgnore
+}
+
+// needsDelivery tells if the payload needs to be delivered to the callback: if it has not been delivered yet, or if
+// its data has changed since and the OnUpdate policy of the callback asks for it. Changes of the labels do not change
+// the generation of a CallbackPayload, changes of its priority do not change its delivery generation.
+func (r *CallbackUrlReconciler) needsDelivery(callback erinnerungv1alpha1.Callback, p *erinnerungv1alpha1.CallbackPayload) bool {
+	d := p.FindDelivery(callback.GetUID())
+	if d == nil || d.Phase == erinnerungv1alpha1.CallbackPayloadSending {
+		return true
+	}
+
+	return r.onUpdate(callback) != erinnerungv1alpha1.OnUpdateIgnore && d.ObservedGeneration < deliveryGeneration(callback, p)
+}
+
+// deliveryGeneration returns the generation of the payload a delivery to the callback sends. It is the generation
+// delivered last as long as the rendered request is the same, a change of the spec not changing the request, like its
+// priority, must neither deliver the payload again nor start the attempts of its delivery over.
+func deliveryGeneration(callback erinnerungv1alpha1.Callback, p *erinnerungv1alpha1.CallbackPayload) int64 {
+	d := p.FindDelivery(callback.GetUID())
+	if d != nil && d.ContentHash != "" && d.ContentHash == requestHash(renderRequest(p)) {
+		return d.ObservedGeneration
+	}
+
+	return p.Generation
+}
+
+// activatedSelector returns the selector and namespaceSelector of the callback, as recorded in its status.
+func activatedSelector(callback erinnerungv1alpha1.Callback) string {
+	spec := callback.CallbackSpec()
+	selector := metav1.FormatLabelSelector(&spec.Selector)
+	if spec.NamespaceSelector != nil {
+		selector += "; namespaces: " + metav1.FormatLabelSelector(spec.NamespaceSelector)
+	}
+
+	return selector
+}
+
+// activate records the activation watermark of the callback, once it is created or its selectors are edited.
+func activate(callback erinnerungv1alpha1.Callback) {
+	status := callback.CallbackStatus()
+	selector := activatedSelector(callback)
+
+	if status.ActivationTime == nil {
+		// the CallbackUrl has been created
+		activation := callback.GetCreationTimestamp()
+		status.ActivationTime = &activation
+		status.ActivatedSelector = selector
+	} else if status.ActivatedSelector != selector {
+		now := metav1.Now()
+		status.ActivationTime = &now
+		status.ActivatedSelector = selector
+	}
+}
+
+// deliversExisting tells if the deliverExisting policy of the callback allows the delivery of the payload. Payloads
+// delivered already are not subject to the policy.
+func deliversExisting(callback erinnerungv1alpha1.Callback, p *erinnerungv1alpha1.CallbackPayload) (bool, error) {
+	if p.FindDelivery(callback.GetUID()) != nil {
+		return true, nil
+	}
+
+	policy, err := erinnerungv1alpha1.ParseDeliverExisting(callback.CallbackSpec().DeliverExisting)
+	if err != nil {
+		return false, err
+	}
+
+	return policy.Delivers(p.CreationTimestamp, callback.CallbackStatus().ActivationTime), nil
+}
+
+// callbackReference returns the namespace/name of a CallbackUrl, or the name of a ClusterCallbackUrl.
+func callbackReference(callback erinnerungv1alpha1.Callback) string {
+	if ns := callback.GetNamespace(); ns != "" {
+		return ns + "/" + callback.GetName()
+	}
+	return callback.GetName()
+}
+
+// finishedDelivery returns the delivery of a finished sender Job, with the HTTP result of the sender's termination
+// message and the reason its container terminated with. The pods are read from the API server, they are not cached.
+func (r *CallbackUrlReconciler) finishedDelivery(ctx context.Context, callback erinnerungv1alpha1.Callback, job *kbatch.Job, failed bool) (erinnerungv1alpha1.CallbackPayloadDelivery, error) {
+	delivery := erinnerungv1alpha1.CallbackPayloadDelivery{
+		Callback:    callbackReference(callback),
+		CallbackUID: callback.GetUID(),
+		Phase:       erinnerungv1alpha1.CallbackPayloadComplete,
+		Job:         job.Name,
+
+		ObservedGeneration: jobPayloadGeneration(job),
+		DeliveryID:         job.Annotations[erinnerungv1alpha1.DeliveryIDAnnotation],
+		ContentHash:        job.Annotations[erinnerungv1alpha1.ContentHashAnnotation],
+	}
+	if failed {
+		delivery.Phase = erinnerungv1alpha1.CallbackPayloadFailed
+		delivery.Reason = "JobFailed"
+	}
+	if until, ok := jobBackPressure(job); ok {
+		delivery.RetryAfter = &metav1.Time{Time: until}
+	}
+
+	reader := r.APIReader
+	if reader == nil {
+		reader = r.Client
+	}
+	var pods corev1.PodList
+	if err := reader.List(ctx, &pods, client.InNamespace(job.Namespace), client.MatchingLabels{"controller-uid": string(job.UID)}); err != nil {
+		return delivery, err
+	}
+
+	// the latest terminated sender container tells about the latest try of the Job
+	var latest *corev1.ContainerStateTerminated
+	for _, pod := range pods.Items {
+		for _, status := range pod.Status.ContainerStatuses {
+			if status.Name != senderContainerName || status.State.Terminated == nil {
+				continue
+			}
+			if latest == nil || latest.FinishedAt.Before(&status.State.Terminated.FinishedAt) {
+				latest = status.State.Terminated
+			}
+		}
+	}
+	if latest == nil {
+		return delivery, nil
+	}
+
+	delivery.Reason = latest.Reason
+	var result senderResult
+	if err := json.Unmarshal([]byte(latest.Message), &result); err != nil {
+		// not a summary, e.g. the tail of the log of a crashed sender
+		delivery.Response = truncate(latest.Message, maxResponseLength)
+		return delivery, nil
+	}
+	delivery.HTTPStatus = result.HTTPStatus
+	delivery.ErrorClass = result.ErrorClass
+	delivery.Response = truncate(result.Response, maxResponseLength)
+	if failed && isBackPressure(result.HTTPStatus) && delivery.RetryAfter == nil {
+		delivery.RetryAfter = &metav1.Time{Time: latest.FinishedAt.Add(parseRetryAfter(result.RetryAfter, latest.FinishedAt.Time))}
+	}
+
+	return delivery, nil
+}
+
+// deliveryReasons are the reasons of the delivery phases, by precedence: the reason of the most relevant phase of the
+// deliveries to all callbacks is the reason of the conditions of the payload's other phases.
+var deliveryReasons = []struct{ phase, reason string }{
+	{erinnerungv1alpha1.CallbackPayloadFailed, "PayloadSendFailed"},
+	{erinnerungv1alpha1.CallbackPayloadSending, "PayloadSending"},
+	{erinnerungv1alpha1.CallbackPayloadComplete, "PayloadSend"},
+	{erinnerungv1alpha1.CallbackPayloadDeduplicated, "DuplicateContent"},
+}
+
+// deliveryMessage returns the message describing the delivery to its callback.
+func deliveryMessage(delivery erinnerungv1alpha1.CallbackPayloadDelivery) string {
+	var details []string
+	if delivery.HTTPStatus != 0 {
+		details = append(details, fmt.Sprintf("HTTP %d", delivery.HTTPStatus))
+	}
+	if delivery.ErrorClass != "" {
+		details = append(details, delivery.ErrorClass)
+	}
+	if delivery.Reason != "" {
+		details = append(details, delivery.Reason)
+	}
+	if delivery.Response != "" {
+		details = append(details, fmt.Sprintf("response %q", delivery.Response))
+	}
+	suffix := ""
+	if len(details) > 0 {
+		suffix = ": " + strings.Join(details, ", ")
+	}
+
+	switch delivery.Phase {
+	case erinnerungv1alpha1.CallbackPayloadComplete:
+		return fmt.Sprintf("The Payload has been send to %s by Job %s%s", delivery.Callback, delivery.Job, suffix)
+	case erinnerungv1alpha1.CallbackPayloadFailed:
+		return fmt.Sprintf("The Payload has failed sending to %s by Job %s%s", delivery.Callback, delivery.Job, suffix)
+	case erinnerungv1alpha1.CallbackPayloadDeduplicated:
+		return fmt.Sprintf("The Payload has not been send to %s, it is a duplicate of %s", delivery.Callback, delivery.DuplicateOf)
+	case erinnerungv1alpha1.CallbackPayloadSending:
+		return fmt.Sprintf("The Payload is been send to %s by Job %s", delivery.Callback, delivery.Job)
+	}
+	return ""
+}
+
+// setDeliveryConditions sets the conditions of the payload's delivery phases from its deliveries to all callbacks, as
+// several callbacks may select the payload. A phase is True while any delivery is in it, naming the callbacks, but
+// Complete only once every delivery has been sent or deduplicated. The conditions of the other phases are set to False.
+func setDeliveryConditions(p *erinnerungv1alpha1.CallbackPayload) {
+	messages := map[string][]string{}
+	var all []string
+	for _, d := range p.Status.Deliveries {
+		message := deliveryMessage(d)
+		if message == "" {
+			continue
+		}
+		messages[d.Phase] = append(messages[d.Phase], message)
+		all = append(all, message)
+	}
+	if len(all) == 0 {
+		return
+	}
+
+	reason := ""
+	for _, r := range deliveryReasons {
+		if len(messages[r.phase]) > 0 {
+			reason = r.reason
+			break
+		}
+	}
+	unfinished := len(messages[erinnerungv1alpha1.CallbackPayloadFailed]) + len(messages[erinnerungv1alpha1.CallbackPayloadSending])
+
+	for _, r := range deliveryReasons {
+		active := len(messages[r.phase]) > 0
+		if r.phase == erinnerungv1alpha1.CallbackPayloadComplete {
+			active = active && unfinished == 0
+		}
+		if active {
+			meta.SetStatusCondition(&p.Status.Conditions, metav1.Condition{
+				Type:    r.phase,
+				Status:  metav1.ConditionTrue,
+				Reason:  r.reason,
+				Message: truncate(strings.Join(messages[r.phase], "; "), maxConditionMessageLength),
+			})
+			continue
+		}
+		// e.g. the Failed condition of an earlier attempt, once a retry succeeded
+		if meta.FindStatusCondition(p.Status.Conditions, r.phase) != nil {
+			meta.SetStatusCondition(&p.Status.Conditions, metav1.Condition{
+				Type:    r.phase,
+				Status:  metav1.ConditionFalse,
+				Reason:  reason,
+				Message: truncate(strings.Join(all, "; "), maxConditionMessageLength),
+			})
+		}
+	}
+}
+
+// truncate truncates s to at most max bytes, without splitting a UTF-8 character.
+func truncate(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	for max > 0 && !utf8.RuneStart(s[max]) {
+		max--
+	}
+	return s[:max]
+}
@@ -0,0 +1,486 @@
+/*
+Copyright (C) 2022 Christoph Görn
+
+This file is part of r-gespraech.
+
+r-gespraech is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+r-gespraech is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with r-gespraech.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package controllers
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	kbatch "k8s.io/api/batch/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/goern/r-gespraech/api/v1alpha1"
+)
+
+var _ = Describe("Delivery status", func() {
+	It("Should copy the failure details into the payload's condition message", func() {
+		callbackPayload := generateCallbackPayload("abc123", "default")
+		delivery := v1alpha1.CallbackPayloadDelivery{
+			Callback:    "default/abc123",
+			CallbackUID: "0a1b2c3d",
+			Phase:       v1alpha1.CallbackPayloadFailed,
+			Job:         "erinnerung-sender-0123456789abcdef",
+			HTTPStatus:  503,
+			ErrorClass:  "ServerError",
+			Reason:      "Error",
+			Response:    "upstream unavailable",
+		}
+		Expect(callbackPayload.SetDelivery(delivery)).To(BeTrue())
+		setDeliveryConditions(callbackPayload)
+
+		condition := meta.FindStatusCondition(callbackPayload.Status.Conditions, v1alpha1.CallbackPayloadFailed)
+		Expect(condition).NotTo(BeNil())
+		Expect(condition.Message).To(ContainSubstring("HTTP 503"))
+		Expect(condition.Message).To(ContainSubstring("ServerError"))
+		Expect(condition.Message).To(ContainSubstring("upstream unavailable"))
+
+		Expect(callbackPayload.SetDelivery(delivery)).To(BeFalse())
+
+		By("By comparing the time the receiver asked to retry after by its value")
+		delivery.RetryAfter = &metav1.Time{Time: time.Now().Truncate(time.Second)}
+		Expect(callbackPayload.SetDelivery(delivery)).To(BeTrue())
+		delivery.RetryAfter = delivery.RetryAfter.DeepCopy()
+		Expect(callbackPayload.SetDelivery(delivery)).To(BeFalse())
+	})
+
+	It("Should clear the conditions of the earlier phases", func() {
+		callbackPayload := generateCallbackPayload("abc123", "default")
+		delivery := v1alpha1.CallbackPayloadDelivery{
+			Callback:    "default/abc123",
+			CallbackUID: "0a1b2c3d",
+			Phase:       v1alpha1.CallbackPayloadSending,
+			Job:         "erinnerung-sender-0123456789abcdef",
+		}
+		callbackPayload.SetDelivery(delivery)
+		setDeliveryConditions(callbackPayload)
+		delivery.Phase = v1alpha1.CallbackPayloadFailed
+		callbackPayload.SetDelivery(delivery)
+		setDeliveryConditions(callbackPayload)
+		Expect(meta.IsStatusConditionFalse(callbackPayload.Status.Conditions, v1alpha1.CallbackPayloadSending)).To(BeTrue())
+		Expect(meta.IsStatusConditionTrue(callbackPayload.Status.Conditions, v1alpha1.CallbackPayloadFailed)).To(BeTrue())
+
+		// the retry succeeds
+		delivery.Phase = v1alpha1.CallbackPayloadComplete
+		delivery.Job = "erinnerung-sender-fedcba9876543210"
+		callbackPayload.SetDelivery(delivery)
+		setDeliveryConditions(callbackPayload)
+		Expect(meta.IsStatusConditionTrue(callbackPayload.Status.Conditions, v1alpha1.CallbackPayloadComplete)).To(BeTrue())
+		Expect(meta.IsStatusConditionFalse(callbackPayload.Status.Conditions, v1alpha1.CallbackPayloadFailed)).To(BeTrue())
+		Expect(meta.IsStatusConditionFalse(callbackPayload.Status.Conditions, v1alpha1.CallbackPayloadSending)).To(BeTrue())
+		Expect(meta.FindStatusCondition(callbackPayload.Status.Conditions, v1alpha1.CallbackPayloadDeduplicated)).To(BeNil())
+	})
+
+	It("Should report the deliveries to all callbacks selecting the payload", func() {
+		callbackPayload := generateCallbackPayload("abc123", "default")
+		failed := v1alpha1.CallbackPayloadDelivery{
+			Callback:    "default/abc123",
+			CallbackUID: "0a1b2c3d",
+			Phase:       v1alpha1.CallbackPayloadFailed,
+			Job:         "erinnerung-sender-0123456789abcdef",
+			HTTPStatus:  500,
+		}
+		complete := v1alpha1.CallbackPayloadDelivery{
+			Callback:    "audit-log",
+			CallbackUID: "4e5f6a7b",
+			Phase:       v1alpha1.CallbackPayloadComplete,
+			Job:         "erinnerung-sender-fedcba9876543210",
+			HTTPStatus:  200,
+		}
+		callbackPayload.SetDelivery(failed)
+		setDeliveryConditions(callbackPayload)
+		callbackPayload.SetDelivery(complete)
+		setDeliveryConditions(callbackPayload)
+
+		condition := meta.FindStatusCondition(callbackPayload.Status.Conditions, v1alpha1.CallbackPayloadFailed)
+		Expect(condition.Status).To(Equal(metav1.ConditionTrue))
+		Expect(condition.Message).To(ContainSubstring("default/abc123"))
+		Expect(condition.Message).NotTo(ContainSubstring("audit-log"))
+		Expect(meta.IsStatusConditionTrue(callbackPayload.Status.Conditions, v1alpha1.CallbackPayloadComplete)).To(BeFalse())
+
+		By("By reporting Complete once every delivery is")
+		failed.Phase = v1alpha1.CallbackPayloadComplete
+		callbackPayload.SetDelivery(failed)
+		setDeliveryConditions(callbackPayload)
+		Expect(meta.IsStatusConditionFalse(callbackPayload.Status.Conditions, v1alpha1.CallbackPayloadFailed)).To(BeTrue())
+		condition = meta.FindStatusCondition(callbackPayload.Status.Conditions, v1alpha1.CallbackPayloadComplete)
+		Expect(condition.Status).To(Equal(metav1.ConditionTrue))
+		Expect(condition.Message).To(ContainSubstring("default/abc123"))
+		Expect(condition.Message).To(ContainSubstring("audit-log"))
+	})
+
+	It("Should truncate the receiver's response without splitting characters", func() {
+		Expect(truncate("short", maxResponseLength)).To(Equal("short"))
+		Expect(truncate(strings.Repeat("ä", maxResponseLength), maxResponseLength)).To(HaveLen(maxResponseLength))
+		Expect(truncate("aä", 2)).To(Equal("a"))
+	})
+})
+
+var _ = Describe("OnUpdate policy", func() {
+	var (
+		callbackUrl     *v1alpha1.CallbackUrl
+		callbackPayload *v1alpha1.CallbackPayload
+	)
+	r := &CallbackUrlReconciler{}
+
+	BeforeEach(func() {
+		callbackUrl = generateCallbackUrl("abc123", "default", "https://localhost.local:8181/webhook/xyz_callback")
+		callbackUrl.UID = "0a1b2c3d"
+		callbackPayload = generateCallbackPayload("abc123", "default")
+		callbackPayload.Generation = 1
+		callbackPayload.SetDelivery(v1alpha1.CallbackPayloadDelivery{
+			CallbackUID:        callbackUrl.UID,
+			Phase:              v1alpha1.CallbackPayloadComplete,
+			ObservedGeneration: 1,
+		})
+	})
+
+	It("Should not redeliver an unchanged payload", func() {
+		callbackUrl.Spec.OnUpdate = v1alpha1.OnUpdateRedeliver
+		Expect(r.needsDelivery(callbackUrl, callbackPayload)).To(BeFalse())
+	})
+
+	It("Should ignore a changed payload by default", func() {
+		callbackPayload.Generation = 2
+		Expect(r.needsDelivery(callbackUrl, callbackPayload)).To(BeFalse())
+	})
+
+	It("Should redeliver a changed payload", func() {
+		callbackPayload.Generation = 2
+		callbackUrl.Spec.OnUpdate = v1alpha1.OnUpdateRedeliver
+		Expect(r.needsDelivery(callbackUrl, callbackPayload)).To(BeTrue())
+		callbackUrl.Spec.OnUpdate = v1alpha1.OnUpdateDeliverPatch
+		Expect(r.needsDelivery(callbackUrl, callbackPayload)).To(BeTrue())
+	})
+
+	It("Should not redeliver a payload whose priority changed only", func() {
+		callbackUrl.Spec.OnUpdate = v1alpha1.OnUpdateRedeliver
+		callbackPayload.SetDelivery(v1alpha1.CallbackPayloadDelivery{
+			CallbackUID:        callbackUrl.UID,
+			Phase:              v1alpha1.CallbackPayloadComplete,
+			ObservedGeneration: 1,
+			ContentHash:        requestHash(renderRequest(callbackPayload)),
+		})
+		id := deliveryID(callbackUrl, callbackPayload)
+
+		callbackPayload.Generation = 2
+		callbackPayload.Spec.Priority = 10
+		Expect(r.needsDelivery(callbackUrl, callbackPayload)).To(BeFalse())
+		Expect(deliveryGeneration(callbackUrl, callbackPayload)).To(Equal(int64(1)))
+		Expect(deliveryID(callbackUrl, callbackPayload)).To(Equal(id))
+
+		By("By redelivering it once its data changes")
+		callbackPayload.Generation = 3
+		callbackPayload.Spec.Data = `{"changed": true}`
+		Expect(r.needsDelivery(callbackUrl, callbackPayload)).To(BeTrue())
+		Expect(deliveryID(callbackUrl, callbackPayload)).NotTo(Equal(id))
+	})
+})
+
+var _ = Describe("Activation watermark", func() {
+	It("Should activate a CallbackUrl again once its selector is edited", func() {
+		callbackUrl := generateCallbackUrl("abc123", "default", "https://localhost.local:8181/webhook/xyz_callback")
+		callbackUrl.CreationTimestamp = metav1.NewTime(time.Now().Add(-time.Hour))
+
+		activate(callbackUrl)
+		Expect(*callbackUrl.Status.ActivationTime).To(Equal(callbackUrl.CreationTimestamp))
+
+		activate(callbackUrl)
+		Expect(*callbackUrl.Status.ActivationTime).To(Equal(callbackUrl.CreationTimestamp))
+
+		callbackUrl.Spec.Selector.MatchLabels = map[string]string{"adviser.thoth-station.ninja/adviser-id": "xyz"}
+		activate(callbackUrl)
+		Expect(callbackUrl.Status.ActivationTime.After(callbackUrl.CreationTimestamp.Time)).To(BeTrue())
+	})
+
+	It("Should not deliver existing CallbackPayloads with the policy none", func() {
+		callbackUrl := generateCallbackUrl("abc123", "default", "https://localhost.local:8181/webhook/xyz_callback")
+		callbackUrl.Spec.DeliverExisting = v1alpha1.DeliverExistingNone
+		callbackUrl.CreationTimestamp = metav1.Now()
+		activate(callbackUrl)
+
+		callbackPayload := generateCallbackPayload("abc123", "default")
+		callbackPayload.CreationTimestamp = metav1.NewTime(time.Now().Add(-time.Hour))
+		ok, err := deliversExisting(callbackUrl, callbackPayload)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ok).To(BeFalse())
+	})
+})
+
+var _ = Describe("Deduplication", func() {
+	It("Should find a payload delivered with the same content within the window", func() {
+		callbackUrl := generateCallbackUrl("abc123", "default", "https://localhost.local:8181/webhook/xyz_callback")
+		callbackUrl.UID = "0a1b2c3d"
+
+		original := generateCallbackPayload("original", "default")
+		original.UID = "1"
+		duplicate := generateCallbackPayload("duplicate", "default")
+		duplicate.UID = "2"
+		hash := requestHash(renderRequest(duplicate))
+		Expect(requestHash(renderRequest(original))).To(Equal(hash))
+
+		original.SetDelivery(v1alpha1.CallbackPayloadDelivery{
+			CallbackUID:        callbackUrl.UID,
+			Phase:              v1alpha1.CallbackPayloadComplete,
+			ContentHash:        hash,
+			LastTransitionTime: metav1.NewTime(time.Now().Add(-time.Minute)),
+		})
+		payloads := []v1alpha1.CallbackPayload{*original, *duplicate}
+
+		found, _ := findDuplicate(callbackUrl, duplicate, hash, time.Hour, payloads)
+		Expect(found).NotTo(BeNil())
+		Expect(found.Name).To(Equal("original"))
+
+		found, _ = findDuplicate(callbackUrl, duplicate, hash, time.Second, payloads)
+		Expect(found).To(BeNil())
+
+		duplicate.Spec.Data = `{"changed": true}`
+		found, _ = findDuplicate(callbackUrl, duplicate, requestHash(renderRequest(duplicate)), time.Hour, payloads)
+		Expect(found).To(BeNil())
+	})
+})
+
+var _ = Describe("Delivery ID", func() {
+	It("Should be the same for every attempt of a delivery", func() {
+		callbackUrl := generateCallbackUrl("abc123", "default", "https://localhost.local:8181/webhook/xyz_callback")
+		callbackUrl.UID = "0a1b2c3d"
+		callbackPayload := generateCallbackPayload("abc123", "default")
+		callbackPayload.UID = "4e5f6a7b"
+		callbackPayload.Generation = 1
+
+		id := deliveryID(callbackUrl, callbackPayload)
+		Expect(jobName(callbackUrl, callbackPayload, 0)).NotTo(Equal(jobName(callbackUrl, callbackPayload, 1)))
+		Expect(deliveryID(callbackUrl, callbackPayload)).To(Equal(id))
+
+		callbackPayload.Generation = 2
+		Expect(deliveryID(callbackUrl, callbackPayload)).NotTo(Equal(id))
+	})
+
+	It("Should send the delivery ID in the configured header", func() {
+		callbackUrl := generateCallbackUrl("abc123", "default", "https://localhost.local:8181/webhook/xyz_callback")
+		job := &kbatch.Job{ObjectMeta: metav1.ObjectMeta{
+			Labels: map[string]string{v1alpha1.AttemptLabel: "2"},
+			Annotations: map[string]string{
+				v1alpha1.DeliveryIDAnnotation:      "0123",
+				v1alpha1.DeliveryAttemptAnnotation: "1",
+			},
+		}}
+
+		r := &CallbackUrlReconciler{IdempotencyKeyHeader: "X-Request-Id"}
+		Expect(string(r.deliveryHeaders(callbackUrl, job))).To(Equal("X-Request-Id: 0123\nErinnerung-Attempt: 1\n"))
+
+		callbackUrl.Spec.IdempotencyKeyHeader = "X-Delivery"
+		Expect(string(r.deliveryHeaders(callbackUrl, job))).To(HavePrefix("X-Delivery: 0123\n"))
+	})
+
+	It("Should number the attempts of every delivery ID from 1", func() {
+		delivery := func(id string, attempt int) kbatch.Job {
+			return kbatch.Job{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{
+				v1alpha1.DeliveryIDAnnotation:      id,
+				v1alpha1.DeliveryAttemptAnnotation: strconv.Itoa(attempt),
+			}}}
+		}
+		// two attempts of the first generation of the payload, one of the second
+		jobs := []kbatch.Job{delivery("0123", 1), delivery("0123", 2), delivery("4567", 1)}
+
+		Expect(nextDeliveryAttempt(jobs, "0123")).To(Equal(3))
+		Expect(nextDeliveryAttempt(jobs, "4567")).To(Equal(2))
+		Expect(nextDeliveryAttempt(jobs, "89ab")).To(Equal(1))
+	})
+})
+
+var _ = Describe("Ordering", func() {
+	var (
+		callbackUrl *v1alpha1.CallbackUrl
+		payloads    []*v1alpha1.CallbackPayload
+	)
+	r := &CallbackUrlReconciler{}
+
+	BeforeEach(func() {
+		callbackUrl = generateCallbackUrl("abc123", "default", "https://localhost.local:8181/webhook/xyz_callback")
+		callbackUrl.Spec.CorrelationKey = "adviser.thoth-station.ninja/adviser-id"
+
+		created := time.Now()
+		payloads = nil
+		for _, name := range []string{"finished", "started", "other"} {
+			p := generateCallbackPayload(name, "default")
+			p.Labels["adviser.thoth-station.ninja/adviser-id"] = "a"
+			if name == "other" {
+				p.Labels["adviser.thoth-station.ninja/adviser-id"] = "b"
+			}
+			p.CreationTimestamp = metav1.NewTime(created)
+			created = created.Add(time.Second)
+			payloads = append(payloads, p)
+		}
+	})
+
+	It("Should deliver all payloads without an ordering", func() {
+		Expect(r.orderPayloads(callbackUrl, payloads)).To(HaveLen(3))
+	})
+
+	It("Should deliver the earliest payload per correlation key", func() {
+		callbackUrl.Spec.Ordering = v1alpha1.OrderingCreation
+		next := r.orderPayloads(callbackUrl, payloads)
+		Expect(next).To(HaveLen(2))
+		Expect(next[0].Name).To(Equal("finished"))
+		Expect(next[1].Name).To(Equal("other"))
+	})
+
+	It("Should deliver the payloads in the order of their sequence annotation", func() {
+		callbackUrl.Spec.Ordering = v1alpha1.OrderingSequence
+		payloads[0].Annotations = map[string]string{v1alpha1.SequenceAnnotation: "2"}
+		payloads[1].Annotations = map[string]string{v1alpha1.SequenceAnnotation: "1"}
+		names := []string{}
+		for _, p := range r.orderPayloads(callbackUrl, payloads) {
+			names = append(names, p.Name)
+		}
+		Expect(names).To(ConsistOf("started", "other"))
+	})
+})
+
+var _ = Describe("Priority", func() {
+	r := &CallbackUrlReconciler{PriorityAging: time.Minute}
+
+	It("Should dispatch higher priorities first, without starving lower ones", func() {
+		now := time.Now()
+		bulk := generateCallbackPayload("bulk", "default")
+		bulk.CreationTimestamp = metav1.NewTime(now.Add(-5 * time.Minute))
+		interactive := generateCallbackPayload("interactive", "default")
+		interactive.Spec.Priority = 10
+		interactive.CreationTimestamp = metav1.NewTime(now)
+
+		payloads := []*v1alpha1.CallbackPayload{bulk, interactive}
+		r.prioritizePayloads(payloads, now)
+		Expect(payloads[0].Name).To(Equal("interactive"))
+
+		By("By aging the waiting bulk payload past a newer interactive one")
+		later := now.Add(6 * time.Minute)
+		Expect(r.effectivePriority(bulk, later)).To(Equal(int64(11)))
+		interactive.CreationTimestamp = metav1.NewTime(later)
+		r.prioritizePayloads(payloads, later)
+		Expect(payloads[0].Name).To(Equal("bulk"))
+	})
+})
+
+var _ = Describe("Back-pressure", func() {
+	It("Should parse the Retry-After header", func() {
+		received := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+		Expect(parseRetryAfter("120", received)).To(Equal(2 * time.Minute))
+		Expect(parseRetryAfter("Wed, 01 Jun 2022 12:05:00 GMT", received)).To(Equal(5 * time.Minute))
+		Expect(parseRetryAfter("", received)).To(Equal(defaultRetryAfter))
+		Expect(parseRetryAfter("86400", received)).To(Equal(maxRetryAfter))
+	})
+
+	It("Should not count back-pressure responses against maxAttempts, up to a cap", func() {
+		callbackUrl := generateCallbackUrl("abc123", "default", "https://localhost.local:8181/webhook/xyz_callback")
+		callbackUrl.UID = "0a1b2c3d"
+		callbackPayload := generateCallbackPayload("abc123", "default")
+		callbackPayload.UID = "4e5f6a7b"
+		callbackPayload.SetDelivery(v1alpha1.CallbackPayloadDelivery{
+			CallbackUID: callbackUrl.UID,
+			Phase:       v1alpha1.CallbackPayloadFailed,
+		})
+
+		failedJob := func(backPressure bool) kbatch.Job {
+			job := kbatch.Job{ObjectMeta: metav1.ObjectMeta{
+				Labels:      map[string]string{v1alpha1.PayloadUIDLabel: string(callbackPayload.UID)},
+				Annotations: map[string]string{v1alpha1.PayloadGenerationAnnotation: "0"},
+			}}
+			job.Status.Conditions = []kbatch.JobCondition{{Type: kbatch.JobFailed, Status: "True"}}
+			if backPressure {
+				job.Annotations[v1alpha1.BackPressureAnnotation] = time.Now().UTC().Format(time.RFC3339)
+			}
+			return job
+		}
+
+		jobs := []kbatch.Job{failedJob(true)}
+		Expect(retriesDelivery(callbackUrl, callbackPayload, jobs)).To(BeTrue())
+
+		jobs = append(jobs, failedJob(false))
+		Expect(retriesDelivery(callbackUrl, callbackPayload, jobs)).To(BeFalse())
+
+		callbackUrl.Spec.MaxAttempts = 2
+		Expect(retriesDelivery(callbackUrl, callbackPayload, jobs)).To(BeTrue())
+		for i := 0; i < maxBackPressureAttempts; i++ {
+			jobs = append(jobs, failedJob(true))
+		}
+		Expect(retriesDelivery(callbackUrl, callbackPayload, jobs)).To(BeFalse())
+	})
+
+	It("Should back off exponentially between the attempts of a failed delivery", func() {
+		callbackUrl := generateCallbackUrl("abc123", "default", "https://localhost.local:8181/webhook/xyz_callback")
+		callbackPayload := generateCallbackPayload("abc123", "default")
+		callbackPayload.UID = "4e5f6a7b"
+		failed := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+
+		failedJob := func(at time.Time, backPressure bool) kbatch.Job {
+			job := kbatch.Job{ObjectMeta: metav1.ObjectMeta{
+				Labels:      map[string]string{v1alpha1.PayloadUIDLabel: string(callbackPayload.UID)},
+				Annotations: map[string]string{v1alpha1.PayloadGenerationAnnotation: "0"},
+			}}
+			job.Status.Conditions = []kbatch.JobCondition{{Type: kbatch.JobFailed, Status: "True", LastTransitionTime: metav1.NewTime(at)}}
+			if backPressure {
+				job.Annotations[v1alpha1.BackPressureAnnotation] = at.Add(time.Minute).Format(time.RFC3339)
+			}
+			return job
+		}
+
+		Expect(backoffUntil(callbackUrl, callbackPayload, nil)).To(BeNil())
+
+		jobs := []kbatch.Job{failedJob(failed, false)}
+		Expect(backoffUntil(callbackUrl, callbackPayload, jobs).Time).To(Equal(failed.Add(retryBackoff)))
+
+		By("By doubling the backoff from the latest failure")
+		jobs = append(jobs, failedJob(failed.Add(time.Minute), false))
+		Expect(backoffUntil(callbackUrl, callbackPayload, jobs).Time).To(Equal(failed.Add(time.Minute + 2*retryBackoff)))
+
+		By("By leaving back-pressure responses to the pause")
+		jobs = append(jobs, failedJob(failed.Add(2*time.Minute), true))
+		Expect(backoffUntil(callbackUrl, callbackPayload, jobs).Time).To(Equal(failed.Add(time.Minute + 2*retryBackoff)))
+
+		By("By capping the backoff")
+		for i := 0; i < 20; i++ {
+			jobs = append(jobs, failedJob(failed, false))
+		}
+		Expect(backoffUntil(callbackUrl, callbackPayload, jobs).Time).To(Equal(failed.Add(time.Minute + maxRetryBackoff)))
+	})
+})
+
+var _ = Describe("Suspension", func() {
+	It("Should report a suspended CallbackUrl, keeping the reason of an automatic suspension", func() {
+		callbackUrl := generateCallbackUrl("abc123", "default", "https://localhost.local:8181/webhook/xyz_callback")
+		setCondition(callbackUrl, v1alpha1.NoAssociatedPayloads, metav1.ConditionTrue, "NoPayloads", "")
+
+		callbackUrl.Spec.Suspend = true
+		setCondition(callbackUrl, v1alpha1.Suspended, metav1.ConditionTrue, "ReceiverGone", "")
+		setSuspendedCondition(callbackUrl)
+		Expect(meta.FindStatusCondition(callbackUrl.Status.Conditions, v1alpha1.Suspended).Reason).To(Equal("ReceiverGone"))
+		Expect(callbackUrl.AggregatePhase()).To(Equal(v1alpha1.PhaseSuspended))
+
+		callbackUrl.Spec.Suspend = false
+		setSuspendedCondition(callbackUrl)
+		Expect(meta.FindStatusCondition(callbackUrl.Status.Conditions, v1alpha1.Suspended)).To(BeNil())
+		Expect(callbackUrl.AggregatePhase()).To(Equal(v1alpha1.PhaseAwaitingPayloads))
+	})
+})
@@ -0,0 +1,141 @@
+/*
+Copyright (C) 2022 Christoph Görn
+
+This file is part of r-gespraech.
+
+r-gespraech is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+r-gespraech is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with r-gespraech.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	erinnerungv1alpha1 "github.com/goern/r-gespraech/api/v1alpha1"
+)
+
+// Resolver resolves host names to IP addresses, it is implemented by net.DefaultResolver.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// conditionError is an error that is reported as a False condition of the CallbackUrl instead of being retried.
+type conditionError struct {
+	conditionType string
+	reason        string
+	message       string
+	// requeue is set if the condition might change without any watched object changing
+	requeue bool
+}
+
+func (e *conditionError) Error() string {
+	return e.message
+}
+
+func newEgressDenied(reason, message string) *conditionError {
+	return &conditionError{conditionType: erinnerungv1alpha1.EgressAllowed, reason: reason, message: message}
+}
+
+// checkEgress resolves the host of targetURL and checks all of its addresses against the EgressPolicy. It returns
+// the address the sender must connect to, in curl's --resolve format (host:port:address), and all of the allowed
+// addresses in that format. Pinning the address makes sure the sender does not resolve the host again, which would
+// allow DNS rebinding. The lowest address is pinned, so the pin does not change with the order of the DNS answers.
+func (r *CallbackUrlReconciler) checkEgress(ctx context.Context, targetURL string) (string, []string, error) {
+	u, err := url.Parse(targetURL)
+	if err != nil {
+		return "", nil, newEgressDenied("InvalidURL", err.Error())
+	}
+
+	host, port, err := erinnerungv1alpha1.URLHostPort(u)
+	if err != nil {
+		return "", nil, newEgressDenied("InvalidURL", err.Error())
+	}
+	if err := r.EgressPolicy.ValidateHostPort(host, port); err != nil {
+		return "", nil, newEgressDenied("EgressDenied", err.Error())
+	}
+
+	var addrs []net.IPAddr
+	if ip := net.ParseIP(host); ip != nil {
+		addrs = []net.IPAddr{{IP: ip}}
+	} else {
+		resolver := r.Resolver
+		if resolver == nil {
+			resolver = net.DefaultResolver
+		}
+
+		addrs, err = resolver.LookupIPAddr(ctx, host)
+		if err == nil && len(addrs) == 0 {
+			err = fmt.Errorf("no addresses found")
+		}
+		if err != nil {
+			condErr := newEgressDenied("ResolutionFailed", fmt.Sprintf("unable to resolve %s: %v", host, err))
+			condErr.requeue = true
+			return "", nil, condErr
+		}
+	}
+
+	// every address must be allowed, otherwise the host could pick a denied one
+	for _, a := range addrs {
+		if err := r.EgressPolicy.ValidateIP(a.IP); err != nil {
+			return "", nil, newEgressDenied("EgressDenied", fmt.Sprintf("%s: %v", host, err))
+		}
+	}
+
+	sort.Slice(addrs, func(i, j int) bool {
+		return bytes.Compare(addrs[i].IP.To16(), addrs[j].IP.To16()) < 0
+	})
+	allowed := make([]string, 0, len(addrs))
+	for _, a := range addrs {
+		address := a.IP.String()
+		if a.IP.To4() == nil {
+			address = "[" + address + "]"
+		}
+		resolve := fmt.Sprintf("%s:%s:%s", host, strconv.Itoa(port), address)
+		if len(allowed) == 0 || allowed[len(allowed)-1] != resolve {
+			allowed = append(allowed, resolve)
+		}
+	}
+
+	return allowed[0], allowed, nil
+}
+
+// parseResolve returns the port and the address of a pinned address in curl's --resolve format.
+func parseResolve(resolve string) (int, net.IP, error) {
+	i := strings.LastIndex(resolve, ":")
+	if strings.HasSuffix(resolve, "]") {
+		i = strings.LastIndex(resolve, ":[")
+	}
+	if i < 0 {
+		return 0, nil, fmt.Errorf("invalid pinned address %q", resolve)
+	}
+	ip := net.ParseIP(strings.Trim(resolve[i+1:], "[]"))
+	hostPort := resolve[:i]
+	j := strings.LastIndex(hostPort, ":")
+	if ip == nil || j < 0 {
+		return 0, nil, fmt.Errorf("invalid pinned address %q", resolve)
+	}
+	port, err := strconv.Atoi(hostPort[j+1:])
+	if err != nil {
+		return 0, nil, fmt.Errorf("invalid pinned address %q", resolve)
+	}
+
+	return port, ip, nil
+}
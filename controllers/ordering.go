@@ -0,0 +1,84 @@
+/*
+Copyright (C) 2022 Christoph Görn
+
+This file is part of r-gespraech.
+
+r-gespraech is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+r-gespraech is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with r-gespraech.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package controllers
+
+import (
+	"sort"
+	"strconv"
+
+	erinnerungv1alpha1 "github.com/goern/r-gespraech/api/v1alpha1"
+)
+
+// payloadSequence returns the sequence number of the payload, 0 if its annotation is missing or invalid.
+func payloadSequence(p *erinnerungv1alpha1.CallbackPayload) int64 {
+	sequence, _ := strconv.ParseInt(p.Annotations[erinnerungv1alpha1.SequenceAnnotation], 10, 64)
+	return sequence
+}
+
+// payloadBefore tells if the payload p is delivered before q with the ordering mode. Payloads with the same sequence
+// number are ordered by their creation.
+func payloadBefore(ordering string, p, q *erinnerungv1alpha1.CallbackPayload) bool {
+	if ordering == erinnerungv1alpha1.OrderingSequence {
+		if ps, qs := payloadSequence(p), payloadSequence(q); ps != qs {
+			return ps < qs
+		}
+	}
+	if !p.CreationTimestamp.Equal(&q.CreationTimestamp) {
+		return p.CreationTimestamp.Before(&q.CreationTimestamp)
+	}
+	if p.Namespace != q.Namespace {
+		return p.Namespace < q.Namespace
+	}
+	return p.Name < q.Name
+}
+
+// orderPayloads returns the payloads to be delivered now according to the ordering of the callback: all of them
+// without an ordering, otherwise only the earliest of the payloads with the same correlation key value. A payload
+// being delivered or retried is still unsent, so it holds back the later ones until it is finished.
+func (r *CallbackUrlReconciler) orderPayloads(callback erinnerungv1alpha1.Callback, unsent []*erinnerungv1alpha1.CallbackPayload) []*erinnerungv1alpha1.CallbackPayload {
+	ordering := callback.CallbackSpec().Ordering
+	if ordering == "" || ordering == erinnerungv1alpha1.OrderingNone {
+		return unsent
+	}
+
+	ordered := make([]*erinnerungv1alpha1.CallbackPayload, len(unsent))
+	copy(ordered, unsent)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return payloadBefore(ordering, ordered[i], ordered[j])
+	})
+
+	// without a correlation key, all the payloads of the callback are delivered in order
+	key := r.correlationKey(callback)
+	heads := map[string]bool{}
+	next := ordered[:0]
+	for _, p := range ordered {
+		value := ""
+		if key != "" {
+			value = p.Labels[key]
+		}
+		if heads[value] {
+			continue
+		}
+		heads[value] = true
+		next = append(next, p)
+	}
+
+	return next
+}
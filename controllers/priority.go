@@ -0,0 +1,68 @@
+/*
+Copyright (C) 2022 Christoph Görn
+
+This file is part of r-gespraech.
+
+r-gespraech is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+r-gespraech is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with r-gespraech.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package controllers
+
+import (
+	"sort"
+	"time"
+
+	kbatch "k8s.io/api/batch/v1"
+
+	erinnerungv1alpha1 "github.com/goern/r-gespraech/api/v1alpha1"
+)
+
+// defaultPriorityAging is the time a waiting payload takes to gain a priority of 1.
+const defaultPriorityAging = time.Minute
+
+// effectivePriority returns the priority of the payload, raised by the time it has been waiting for its delivery so a
+// payload with a low priority is eventually delivered before newer ones with a higher priority.
+func (r *CallbackUrlReconciler) effectivePriority(p *erinnerungv1alpha1.CallbackPayload, now time.Time) int64 {
+	aging := r.PriorityAging
+	if aging <= 0 {
+		aging = defaultPriorityAging
+	}
+
+	priority := int64(p.Spec.Priority)
+	if waiting := now.Sub(p.CreationTimestamp.Time); waiting > 0 {
+		priority += int64(waiting / aging)
+	}
+
+	return priority
+}
+
+// prioritizePayloads sorts the payloads by their effective priority, highest first. Payloads with the same effective
+// priority keep their order.
+func (r *CallbackUrlReconciler) prioritizePayloads(payloads []*erinnerungv1alpha1.CallbackPayload, now time.Time) {
+	sort.SliceStable(payloads, func(i, j int) bool {
+		return r.effectivePriority(payloads[i], now) > r.effectivePriority(payloads[j], now)
+	})
+}
+
+// activeDeliveries returns the number of unfinished sender Jobs.
+func activeDeliveries(jobs []kbatch.Job) int32 {
+	active := int32(0)
+	for i := range jobs {
+		if finished, _ := jobFinished(&jobs[i]); !finished {
+			active++
+		}
+	}
+
+	return active
+}
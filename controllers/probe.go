@@ -0,0 +1,279 @@
+/*
+Copyright (C) 2022 Christoph Görn
+
+This file is part of r-gespraech.
+
+r-gespraech is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+r-gespraech is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with r-gespraech.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"syscall"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	erinnerungv1alpha1 "github.com/goern/r-gespraech/api/v1alpha1"
+)
+
+const (
+	// defaultProbeInterval is the time between probes of a callback target.
+	defaultProbeInterval = 5 * time.Minute
+	// defaultProbeTimeout is the time a probe waits for the response of the callback target.
+	defaultProbeTimeout = 5 * time.Second
+)
+
+// probeInterval returns the time between probes of the callback target, it is 0 if probing is disabled.
+func probeInterval(callback erinnerungv1alpha1.Callback) time.Duration {
+	probe := callback.CallbackSpec().Probe
+	if probe == nil {
+		return 0
+	}
+	if probe.Interval != nil && probe.Interval.Duration > 0 {
+		return probe.Interval.Duration
+	}
+	return defaultProbeInterval
+}
+
+// nextProbe returns the time until the next probe of the callback target is due.
+func nextProbe(callback erinnerungv1alpha1.Callback, now time.Time) (time.Duration, bool) {
+	interval := probeInterval(callback)
+	if interval == 0 {
+		return 0, false
+	}
+	last := callback.CallbackStatus().LastProbeTime
+	if last == nil {
+		return 0, true
+	}
+	if next := last.Add(interval).Sub(now); next > 0 {
+		return next, true
+	}
+	return 0, true
+}
+
+// requeueChecks requeues the reconciliation of the callback once its next probe or verification is due, unless it is
+// requeued earlier. A running check reconciles the callback once it has finished.
+func (r *CallbackUrlReconciler) requeueChecks(callback erinnerungv1alpha1.Callback, result ctrl.Result) ctrl.Result {
+	now := time.Now()
+	next, ok := nextProbe(callback, now)
+	if ok && r.checks.isRunning(callback.GetUID(), probeCheck) {
+		ok = false
+	}
+	if verification, due := nextVerification(callback, now); due && !r.checks.isRunning(callback.GetUID(), verificationCheck) && (!ok || verification < next) {
+		next, ok = verification, true
+	}
+	if !ok || result.Requeue {
+		return result
+	}
+	if next < time.Second {
+		next = time.Second
+	}
+	if result.RequeueAfter == 0 || next < result.RequeueAfter {
+		result.RequeueAfter = next
+	}
+
+	return result
+}
+
+// guardedDialer returns a dialer resolving with the resolver and connecting only to the addresses and ports allowed
+// by the EgressPolicy. The address is checked right before connecting, so DNS rebinding can not bypass the check.
+func (r *CallbackUrlReconciler) guardedDialer(timeout time.Duration, guard bool) func(ctx context.Context, network, address string) (net.Conn, error) {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: func(_, address string, _ syscall.RawConn) error {
+			if !guard {
+				return nil
+			}
+			host, port, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil {
+				return fmt.Errorf("the address %s is not an IP address", host)
+			}
+			p, err := strconv.Atoi(port)
+			if err != nil {
+				return err
+			}
+			if err := r.EgressPolicy.ValidatePort(p); err != nil {
+				return err
+			}
+			return r.EgressPolicy.ValidateIP(ip)
+		},
+	}
+
+	resolver := r.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		if net.ParseIP(host) != nil {
+			return dialer.DialContext(ctx, network, address)
+		}
+
+		addrs, err := resolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		if len(addrs) == 0 {
+			return nil, fmt.Errorf("no addresses found for %s", host)
+		}
+		for _, a := range addrs {
+			var conn net.Conn
+			conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(a.IP.String(), port))
+			if err == nil {
+				return conn, nil
+			}
+		}
+		return nil, err
+	}
+}
+
+// guardedClient returns an HTTP client for the checks of callback targets made by the operator itself, connecting
+// with the guardedDialer. Redirects are not followed, they could lead to any address.
+func (r *CallbackUrlReconciler) guardedClient(timeout time.Duration, guard bool) *http.Client {
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext:       r.guardedDialer(timeout, guard),
+			DisableKeepAlives: true,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// probeRequest returns the request probing the callback target.
+func probeRequest(ctx context.Context, probe *erinnerungv1alpha1.ProbeSpec, targetURL string) (*http.Request, error) {
+	u, err := url.Parse(targetURL)
+	if err != nil {
+		return nil, err
+	}
+	if probe.Path != "" {
+		u.Path = probe.Path
+		u.RawPath = ""
+		u.RawQuery = ""
+	}
+	method := probe.Method
+	if method == "" {
+		method = http.MethodHead
+	}
+
+	return http.NewRequestWithContext(ctx, method, u.String(), nil)
+}
+
+// probeTimeout returns the time a probe waits for the response of the callback target, at most MaxProbeTimeout.
+func probeTimeout(probe *erinnerungv1alpha1.ProbeSpec) time.Duration {
+	if probe.Timeout == nil || probe.Timeout.Duration <= 0 {
+		return defaultProbeTimeout
+	}
+	if probe.Timeout.Duration > erinnerungv1alpha1.MaxProbeTimeout {
+		return erinnerungv1alpha1.MaxProbeTimeout
+	}
+	return probe.Timeout.Duration
+}
+
+// unguardedTarget tells if the operator may probe and verify the callback target without the EgressPolicy guarding
+// the connection: only an in-cluster Service in the namespace of a CallbackUrl, or any for a ClusterCallbackUrl created
+// by a cluster admin. Any other target is controlled by the tenant and guarded.
+func unguardedTarget(callback erinnerungv1alpha1.Callback, inCluster bool) bool {
+	ref := callback.CallbackSpec().ServiceRef
+	if !inCluster || ref == nil {
+		return false
+	}
+	ns := callback.GetNamespace()
+
+	return ns == "" || serviceRefNamespace(ref, ns) == ns
+}
+
+// probe records the result of the latest probe of the callback target by the Reachable condition, and starts the
+// next probe in the background once it is due.
+func (r *CallbackUrlReconciler) probe(ctx context.Context, callback erinnerungv1alpha1.Callback, targetURL string, guard bool) {
+	status := callback.CallbackStatus()
+	probe := callback.CallbackSpec().Probe
+	if probe == nil {
+		// discard the result of a probe started before probing was disabled
+		r.checks.result(callback.GetUID(), probeCheck)
+		meta.RemoveStatusCondition(&status.Conditions, erinnerungv1alpha1.Reachable)
+		status.LastProbeTime = nil
+		status.ProbeLatency = nil
+		return
+	}
+
+	if result, ok := r.checks.result(callback.GetUID(), probeCheck); ok {
+		applyProbe(callback, result)
+	}
+	if next, _ := nextProbe(callback, time.Now()); next > 0 {
+		return
+	}
+
+	timeout := probeTimeout(probe)
+	r.checks.start(ctx, callback, probeCheck, timeout, func(ctx context.Context) checkResult {
+		return r.runProbe(ctx, probe.DeepCopy(), targetURL, timeout, guard)
+	})
+}
+
+// applyProbe records the result of a probe in the status of the callback.
+func applyProbe(callback erinnerungv1alpha1.Callback, result checkResult) {
+	status := callback.CallbackStatus()
+	status.LastProbeTime = &result.started
+	status.ProbeLatency = result.latency
+	setCondition(callback, erinnerungv1alpha1.Reachable, result.status, result.reason, result.message)
+}
+
+// runProbe probes the callback target. Any response but a server error tells the target is reachable, redirects are
+// not followed. Targets outside of the cluster are guarded by the EgressPolicy.
+func (r *CallbackUrlReconciler) runProbe(ctx context.Context, probe *erinnerungv1alpha1.ProbeSpec, targetURL string, timeout time.Duration, guard bool) checkResult {
+	result := checkResult{started: metav1.Now(), status: metav1.ConditionFalse}
+	httpClient := r.guardedClient(timeout, guard)
+
+	req, err := probeRequest(ctx, probe, targetURL)
+	if err != nil {
+		result.reason, result.message = "InvalidProbe", err.Error()
+		return result
+	}
+	resp, err := httpClient.Do(req)
+	latency := time.Since(result.started.Time).Round(time.Millisecond)
+	if err != nil {
+		result.reason, result.message = "Unreachable", fmt.Sprintf("the probe failed: %v", err)
+		return result
+	}
+	resp.Body.Close()
+
+	result.latency = &metav1.Duration{Duration: latency}
+	// the response of the target is not echoed, the probe must not read in-cluster Services for the tenant
+	if resp.StatusCode >= http.StatusInternalServerError {
+		result.reason, result.message = "ServerError", fmt.Sprintf("the probe %s %s responded with a server error in %s", req.Method, req.URL.Path, latency)
+		return result
+	}
+	result.message = fmt.Sprintf("the probe %s %s responded in %s", req.Method, req.URL.Path, latency)
+	result.status, result.reason = metav1.ConditionTrue, "Responded"
+	return result
+}
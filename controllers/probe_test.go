@@ -0,0 +1,259 @@
+/*
+Copyright (C) 2022 Christoph Görn
+
+This file is part of r-gespraech.
+
+r-gespraech is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+r-gespraech is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with r-gespraech.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/goern/r-gespraech/api/v1alpha1"
+)
+
+var _ = Describe("Reachability probe", func() {
+	var (
+		receiver    *httptest.Server
+		callbackUrl *v1alpha1.CallbackUrl
+	)
+
+	BeforeEach(func() {
+		receiver = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.URL.Path == "/healthz" {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}))
+		callbackUrl = generateCallbackUrl("abc123", "default", receiver.URL+"/webhook/xyz_callback")
+		callbackUrl.Spec.Probe = &v1alpha1.ProbeSpec{}
+	})
+
+	AfterEach(func() {
+		receiver.Close()
+	})
+
+	It("Should report a responding target as Reachable, with its latency", func() {
+		r := &CallbackUrlReconciler{EgressPolicy: &v1alpha1.EgressPolicy{AllowedCIDRs: []string{"127.0.0.0/8"}}}
+		applyProbe(callbackUrl, r.runProbe(context.Background(), callbackUrl.Spec.Probe, callbackUrl.Spec.URL, defaultProbeTimeout, true))
+
+		Expect(meta.IsStatusConditionTrue(callbackUrl.Status.Conditions, v1alpha1.Reachable)).To(BeTrue())
+		Expect(callbackUrl.Status.ProbeLatency).NotTo(BeNil())
+		Expect(callbackUrl.Status.LastProbeTime).NotTo(BeNil())
+
+		next, ok := nextProbe(callbackUrl, callbackUrl.Status.LastProbeTime.Time)
+		Expect(ok).To(BeTrue())
+		Expect(next).To(Equal(defaultProbeInterval))
+	})
+
+	It("Should report a server error of the health path as not Reachable", func() {
+		r := &CallbackUrlReconciler{EgressPolicy: &v1alpha1.EgressPolicy{AllowedCIDRs: []string{"127.0.0.0/8"}}}
+		callbackUrl.Spec.Probe.Path = "/healthz"
+		applyProbe(callbackUrl, r.runProbe(context.Background(), callbackUrl.Spec.Probe, callbackUrl.Spec.URL, defaultProbeTimeout, true))
+
+		condition := meta.FindStatusCondition(callbackUrl.Status.Conditions, v1alpha1.Reachable)
+		Expect(condition.Status).To(Equal(metav1.ConditionFalse))
+		Expect(condition.Reason).To(Equal("ServerError"))
+		Expect(condition.Message).NotTo(ContainSubstring("503"))
+		Expect(callbackUrl.AggregatePhase()).To(Equal(v1alpha1.PhaseUnreachable))
+	})
+
+	It("Should not connect to an address denied by the EgressPolicy", func() {
+		r := &CallbackUrlReconciler{}
+		applyProbe(callbackUrl, r.runProbe(context.Background(), callbackUrl.Spec.Probe, callbackUrl.Spec.URL, defaultProbeTimeout, true))
+
+		condition := meta.FindStatusCondition(callbackUrl.Status.Conditions, v1alpha1.Reachable)
+		Expect(condition.Status).To(Equal(metav1.ConditionFalse))
+		Expect(strings.Contains(condition.Message, "denied network")).To(BeTrue())
+	})
+
+	It("Should only probe the Services of the callback's own namespace unguarded", func() {
+		Expect(unguardedTarget(callbackUrl, false)).To(BeFalse())
+
+		callbackUrl.Spec.ServiceRef = &v1alpha1.ServiceReference{Name: "receiver", Port: 8080}
+		Expect(unguardedTarget(callbackUrl, true)).To(BeTrue())
+		callbackUrl.Spec.ServiceRef.Namespace = "kube-system"
+		Expect(unguardedTarget(callbackUrl, true)).To(BeFalse())
+
+		clusterCallbackUrl := &v1alpha1.ClusterCallbackUrl{Spec: v1alpha1.CallbackUrlSpec{
+			ServiceRef: &v1alpha1.ServiceReference{Name: "receiver", Namespace: "receivers", Port: 8080},
+		}}
+		Expect(unguardedTarget(clusterCallbackUrl, true)).To(BeTrue())
+		Expect(unguardedTarget(clusterCallbackUrl, false)).To(BeFalse())
+	})
+
+	It("Should probe in the background, and record the result once it has finished", func() {
+		release := make(chan struct{})
+		slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			<-release
+		}))
+		defer slow.Close()
+		defer close(release)
+
+		r := &CallbackUrlReconciler{EgressPolicy: &v1alpha1.EgressPolicy{AllowedCIDRs: []string{"127.0.0.0/8"}}, checks: newTargetChecks()}
+		callbackUrl.UID = "0a1b2c3d"
+		callbackUrl.Spec.Probe.Timeout = &metav1.Duration{Duration: time.Hour}
+
+		started := time.Now()
+		r.probe(context.Background(), callbackUrl, slow.URL, true)
+		Expect(time.Since(started)).To(BeNumerically("<", time.Second))
+		Expect(meta.FindStatusCondition(callbackUrl.Status.Conditions, v1alpha1.Reachable)).To(BeNil())
+		Expect(r.checks.isRunning(callbackUrl.UID, probeCheck)).To(BeTrue())
+		Expect(probeTimeout(callbackUrl.Spec.Probe)).To(Equal(v1alpha1.MaxProbeTimeout))
+
+		release <- struct{}{}
+		Eventually(r.checks.finished).Should(Receive())
+		r.probe(context.Background(), callbackUrl, slow.URL, true)
+		Expect(meta.IsStatusConditionTrue(callbackUrl.Status.Conditions, v1alpha1.Reachable)).To(BeTrue())
+		Expect(r.checks.isRunning(callbackUrl.UID, probeCheck)).To(BeFalse())
+	})
+
+	It("Should cancel the probe of a deleted callback", func() {
+		hold := make(chan struct{})
+		slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			select {
+			case <-hold:
+			case <-req.Context().Done():
+			}
+		}))
+		defer slow.Close()
+		defer close(hold)
+
+		r := &CallbackUrlReconciler{EgressPolicy: &v1alpha1.EgressPolicy{AllowedCIDRs: []string{"127.0.0.0/8"}}, checks: newTargetChecks()}
+		callbackUrl.UID = "4e5f6a7b"
+
+		r.probe(context.Background(), callbackUrl, slow.URL, true)
+		Expect(r.checks.isRunning(callbackUrl.UID, probeCheck)).To(BeTrue())
+
+		r.checks.cancel(callbackUrl.UID)
+		Expect(r.checks.isRunning(callbackUrl.UID, probeCheck)).To(BeFalse())
+		Consistently(r.checks.finished, 200*time.Millisecond).ShouldNot(Receive())
+		_, ok := r.checks.result(callbackUrl.UID, probeCheck)
+		Expect(ok).To(BeFalse())
+	})
+})
+
+var _ = Describe("Verification handshake", func() {
+	var receiver *httptest.Server
+	r := &CallbackUrlReconciler{EgressPolicy: &v1alpha1.EgressPolicy{AllowedCIDRs: []string{"127.0.0.0/8"}}, checks: newTargetChecks()}
+
+	// verify starts the verification, and records its result once it has finished
+	verify := func(callbackUrl *v1alpha1.CallbackUrl) {
+		Expect(r.verify(context.Background(), callbackUrl, callbackUrl.Spec.URL, true)).To(Succeed())
+		Eventually(r.checks.finished).Should(Receive())
+		Expect(r.verify(context.Background(), callbackUrl, callbackUrl.Spec.URL, true)).To(Succeed())
+	}
+
+	BeforeEach(func() {
+		receiver = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			var challenge challengeRequest
+			Expect(json.NewDecoder(req.Body).Decode(&challenge)).To(Succeed())
+			Expect(challenge.Type).To(Equal(challengeType))
+			switch req.URL.Path {
+			case "/plain":
+				_, _ = w.Write([]byte(challenge.Challenge))
+			case "/json":
+				_ = json.NewEncoder(w).Encode(challenge)
+			default:
+				_, _ = w.Write([]byte("ok"))
+			}
+		}))
+	})
+
+	AfterEach(func() {
+		receiver.Close()
+	})
+
+	It("Should verify a receiver echoing the challenge", func() {
+		for _, path := range []string{"/plain", "/json"} {
+			callbackUrl := generateCallbackUrl("abc123", "default", receiver.URL+path)
+			callbackUrl.Spec.Verification = &v1alpha1.VerificationSpec{}
+			Expect(verified(callbackUrl)).To(BeFalse())
+
+			verify(callbackUrl)
+			Expect(verified(callbackUrl)).To(BeTrue())
+			Expect(callbackUrl.Status.VerifiedTime).NotTo(BeNil())
+
+			next, _ := nextVerification(callbackUrl, callbackUrl.Status.LastVerificationTime.Time)
+			Expect(next).To(Equal(defaultVerificationInterval))
+		}
+	})
+
+	It("Should keep a receiver not echoing the challenge Verifying", func() {
+		callbackUrl := generateCallbackUrl("abc123", "default", receiver.URL+"/other")
+		callbackUrl.Spec.Verification = &v1alpha1.VerificationSpec{}
+
+		verify(callbackUrl)
+		Expect(verified(callbackUrl)).To(BeFalse())
+		Expect(meta.FindStatusCondition(callbackUrl.Status.Conditions, v1alpha1.Verified).Reason).To(Equal("ChallengeMismatch"))
+		Expect(callbackUrl.AggregatePhase()).To(Equal(v1alpha1.PhaseVerifying))
+
+		next, _ := nextVerification(callbackUrl, callbackUrl.Status.LastVerificationTime.Time)
+		Expect(next).To(Equal(verificationRetryInterval))
+	})
+
+	It("Should be Verifying until the first verification has finished", func() {
+		callbackUrl := generateCallbackUrl("abc123", "default", receiver.URL+"/plain")
+		callbackUrl.Spec.Verification = &v1alpha1.VerificationSpec{}
+		setCondition(callbackUrl, v1alpha1.NoAssociatedPayloads, metav1.ConditionFalse, "PayloadsFound", "")
+
+		Expect(r.verify(context.Background(), callbackUrl, callbackUrl.Spec.URL, true)).To(Succeed())
+		condition := meta.FindStatusCondition(callbackUrl.Status.Conditions, v1alpha1.Verified)
+		Expect(condition.Status).To(Equal(metav1.ConditionUnknown))
+		Expect(condition.Reason).To(Equal("Pending"))
+		Expect(callbackUrl.AggregatePhase()).To(Equal(v1alpha1.PhaseVerifying))
+
+		Eventually(r.checks.finished).Should(Receive())
+		Expect(r.verify(context.Background(), callbackUrl, callbackUrl.Spec.URL, true)).To(Succeed())
+		Expect(verified(callbackUrl)).To(BeTrue())
+	})
+
+	It("Should verify a changed target again, dropping the result for the earlier one", func() {
+		callbackUrl := generateCallbackUrl("abc123", "default", receiver.URL+"/plain")
+		callbackUrl.Spec.Verification = &v1alpha1.VerificationSpec{}
+		verify(callbackUrl)
+		Expect(verified(callbackUrl)).To(BeTrue())
+		Expect(callbackUrl.Status.VerifiedTarget).To(Equal(receiver.URL + "/plain"))
+
+		By("By changing the url to a receiver not echoing the challenge")
+		callbackUrl.Spec.URL = receiver.URL + "/other"
+		Expect(r.verify(context.Background(), callbackUrl, callbackUrl.Spec.URL, true)).To(Succeed())
+		Expect(verified(callbackUrl)).To(BeFalse())
+		Expect(callbackUrl.Status.VerifiedTime).To(BeNil())
+		Expect(callbackUrl.Status.VerifiedTarget).To(Equal(receiver.URL + "/other"))
+
+		By("By dropping a result for the earlier target")
+		Eventually(r.checks.finished).Should(Receive())
+		callbackUrl.Spec.URL = receiver.URL + "/plain"
+		Expect(r.verify(context.Background(), callbackUrl, callbackUrl.Spec.URL, true)).To(Succeed())
+		Expect(verified(callbackUrl)).To(BeFalse())
+		Eventually(r.checks.finished).Should(Receive())
+		Expect(r.verify(context.Background(), callbackUrl, callbackUrl.Spec.URL, true)).To(Succeed())
+		Expect(verified(callbackUrl)).To(BeTrue())
+	})
+})
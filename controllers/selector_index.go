@@ -0,0 +1,148 @@
+/*
+Copyright (C) 2022 Christoph Görn
+
+This file is part of r-gespraech.
+
+r-gespraech is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+r-gespraech is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with r-gespraech.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package controllers
+
+import (
+	"context"
+	"sync"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	toolscache "k8s.io/client-go/tools/cache"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	erinnerungv1alpha1 "github.com/goern/r-gespraech/api/v1alpha1"
+)
+
+// selectorIndex is the reverse mapping from CallbackPayloads to the CallbackUrls (or ClusterCallbackUrls) selecting
+// them. It holds the parsed `selector` of every cached callback, bucketed by namespace, so a payload event evaluates
+// only the selectors of its own namespace plus those matching across namespaces.
+type selectorIndex struct {
+	mu sync.RWMutex
+	// local holds the selectors of the callbacks matching payloads of their own namespace, by namespace
+	local map[string]map[types.NamespacedName]labels.Selector
+	// cross holds the selectors of the callbacks with a `namespaceSelector` and of all cluster-scoped callbacks
+	cross map[types.NamespacedName]labels.Selector
+}
+
+func newSelectorIndex() *selectorIndex {
+	return &selectorIndex{
+		local: map[string]map[types.NamespacedName]labels.Selector{},
+		cross: map[types.NamespacedName]labels.Selector{},
+	}
+}
+
+// set adds or replaces the selector of the callback.
+func (i *selectorIndex) set(callback erinnerungv1alpha1.Callback) {
+	key := types.NamespacedName{Namespace: callback.GetNamespace(), Name: callback.GetName()}
+	spec := callback.CallbackSpec()
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.deleteLocked(key)
+
+	selector, err := metav1.LabelSelectorAsSelector(&spec.Selector)
+	if err != nil {
+		// the callback reports the invalid selector itself, it does not select any payload
+		return
+	}
+
+	if key.Namespace == "" || spec.NamespaceSelector != nil {
+		i.cross[key] = selector
+		return
+	}
+	if i.local[key.Namespace] == nil {
+		i.local[key.Namespace] = map[types.NamespacedName]labels.Selector{}
+	}
+	i.local[key.Namespace][key] = selector
+}
+
+// delete removes the selector of the callback.
+func (i *selectorIndex) delete(key types.NamespacedName) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.deleteLocked(key)
+}
+
+func (i *selectorIndex) deleteLocked(key types.NamespacedName) {
+	delete(i.cross, key)
+	if bucket, ok := i.local[key.Namespace]; ok {
+		delete(bucket, key)
+		if len(bucket) == 0 {
+			delete(i.local, key.Namespace)
+		}
+	}
+}
+
+// match returns a reconcile.Request for every callback whose selector matches the labels of a payload in namespace.
+// The callbacks matching across namespaces are filtered by allowCross, which may be nil to allow all of them.
+func (i *selectorIndex) match(namespace string, set labels.Set, allowCross func(key types.NamespacedName) bool) []reconcile.Request {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	requests := []reconcile.Request{}
+	for key, selector := range i.local[namespace] {
+		if selector.Matches(set) {
+			requests = append(requests, reconcile.Request{NamespacedName: key})
+		}
+	}
+	for key, selector := range i.cross {
+		if (allowCross == nil || allowCross(key)) && selector.Matches(set) {
+			requests = append(requests, reconcile.Request{NamespacedName: key})
+		}
+	}
+
+	return requests
+}
+
+// watch keeps the index up to date with the events of the cached callbacks of the same kind as obj.
+func (i *selectorIndex) watch(mgr ctrl.Manager, obj erinnerungv1alpha1.Callback) error {
+	informer, err := mgr.GetCache().GetInformer(context.Background(), obj)
+	if err != nil {
+		return err
+	}
+
+	informer.AddEventHandler(toolscache.ResourceEventHandlerFuncs{
+		AddFunc: func(o interface{}) {
+			if callback, ok := o.(erinnerungv1alpha1.Callback); ok {
+				i.set(callback)
+			}
+		},
+		UpdateFunc: func(_, o interface{}) {
+			if callback, ok := o.(erinnerungv1alpha1.Callback); ok {
+				i.set(callback)
+			}
+		},
+		DeleteFunc: func(o interface{}) {
+			if tombstone, ok := o.(toolscache.DeletedFinalStateUnknown); ok {
+				o = tombstone.Obj
+			}
+			if callback, ok := o.(erinnerungv1alpha1.Callback); ok {
+				i.delete(types.NamespacedName{Namespace: callback.GetNamespace(), Name: callback.GetName()})
+			}
+		},
+	})
+
+	return nil
+}
@@ -0,0 +1,80 @@
+/*
+Copyright (C) 2022 Christoph Görn
+
+This file is part of r-gespraech.
+
+r-gespraech is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+r-gespraech is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with r-gespraech.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package controllers
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/goern/r-gespraech/api/v1alpha1"
+)
+
+var _ = Describe("selectorIndex", func() {
+	var index *selectorIndex
+	payloadLabels := labels.Set{"adviser.thoth-station.ninja/adviser-id": "abc123"}
+
+	BeforeEach(func() {
+		index = newSelectorIndex()
+		index.set(generateCallbackUrl("abc123", "tenant-a", "https://localhost.local/a"))
+		index.set(generateCallbackUrl("other", "tenant-a", "https://localhost.local/b"))
+		index.set(generateCallbackUrl("abc123", "tenant-b", "https://localhost.local/c"))
+	})
+
+	It("Should map a payload to the CallbackUrls of its namespace selecting it", func() {
+		Expect(index.match("tenant-a", payloadLabels, nil)).To(ConsistOf(
+			reconcile.Request{NamespacedName: types.NamespacedName{Namespace: "tenant-a", Name: "abc123"}},
+		))
+	})
+
+	It("Should map a payload to the CallbackUrls with a namespaceSelector allowed to receive it", func() {
+		cross := generateCallbackUrl("abc123", "tenant-c", "https://localhost.local/d")
+		cross.Spec.NamespaceSelector = &metav1.LabelSelector{}
+		index.set(cross)
+
+		Expect(index.match("tenant-a", payloadLabels, nil)).To(HaveLen(2))
+		Expect(index.match("tenant-a", payloadLabels, func(key types.NamespacedName) bool { return false })).To(HaveLen(1))
+	})
+
+	It("Should map a payload to the ClusterCallbackUrls selecting it", func() {
+		index.set(&v1alpha1.ClusterCallbackUrl{
+			ObjectMeta: metav1.ObjectMeta{Name: "cluster"},
+			Spec:       v1alpha1.CallbackUrlSpec{Selector: metav1.LabelSelector{MatchLabels: payloadLabels}},
+		})
+
+		Expect(index.match("tenant-z", payloadLabels, nil)).To(ConsistOf(
+			reconcile.Request{NamespacedName: types.NamespacedName{Name: "cluster"}},
+		))
+	})
+
+	It("Should follow updated selectors and deleted CallbackUrls", func() {
+		updated := generateCallbackUrl("abc123", "tenant-a", "https://localhost.local/a")
+		updated.Spec.Selector.MatchLabels = map[string]string{"adviser.thoth-station.ninja/adviser-id": "xyz"}
+		index.set(updated)
+		Expect(index.match("tenant-a", payloadLabels, nil)).To(BeEmpty())
+
+		index.delete(types.NamespacedName{Namespace: "tenant-b", Name: "abc123"})
+		Expect(index.match("tenant-b", payloadLabels, nil)).To(BeEmpty())
+	})
+})
@@ -0,0 +1,229 @@
+/*
+Copyright (C) 2022 Christoph Görn
+
+This file is part of r-gespraech.
+
+r-gespraech is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+r-gespraech is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with r-gespraech.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"sort"
+
+	kbatch "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	erinnerungv1alpha1 "github.com/goern/r-gespraech/api/v1alpha1"
+)
+
+// networkPolicyName returns the name of the NetworkPolicy restricting the egress of the callback's sender pods.
+func networkPolicyName(callback erinnerungv1alpha1.Callback) string {
+	sum := sha256.Sum256([]byte(callback.GetUID()))
+
+	return "erinnerung-sender-" + hex.EncodeToString(sum[:])[:16]
+}
+
+// clusterDNSLabels are the labels of the cluster DNS pods in the kube-system namespace, the only DNS servers the sender
+// pods of an in-cluster Service may query.
+var clusterDNSLabels = map[string]string{"k8s-app": "kube-dns"}
+
+// reconcileNetworkPolicy creates or updates the NetworkPolicy limiting the egress of the callback's sender pods to
+// the target: the allowed addresses and port for targets outside of the cluster, or the target port in the namespace
+// of the referenced Service (and the cluster DNS) for in-cluster Services. The addresses the unfinished sender Jobs are
+// pinned to stay allowed, so they are not blocked once the target resolves to other addresses.
+func (r *CallbackUrlReconciler) reconcileNetworkPolicy(ctx context.Context, callback erinnerungv1alpha1.Callback, targetURL string, allowed []string) error {
+	var svc *corev1.Service
+	if ref := callback.CallbackSpec().ServiceRef; ref != nil && len(allowed) == 0 {
+		svc = &corev1.Service{}
+		key := types.NamespacedName{Name: ref.Name, Namespace: serviceRefNamespace(ref, r.jobNamespace(callback))}
+		if err := r.Get(ctx, key, svc); err != nil {
+			return err
+		}
+	}
+
+	var senderJobs kbatch.JobList
+	if err := r.List(ctx, &senderJobs, client.InNamespace(r.jobNamespace(callback)), client.MatchingFields{jobOwnerKeyFor(callback): callback.GetName()}); err != nil {
+		return err
+	}
+	resolves := append([]string{}, allowed...)
+	for i := range senderJobs.Items {
+		j := &senderJobs.Items[i]
+		if finished, _ := jobFinished(j); finished {
+			continue
+		}
+		if resolve := jobPinnedAddress(j); resolve != "" {
+			resolves = append(resolves, resolve)
+		}
+	}
+
+	egress, err := r.senderEgressRules(callback, targetURL, resolves, svc)
+	if err != nil {
+		return err
+	}
+
+	policy := &networkingv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: networkPolicyName(callback), Namespace: r.jobNamespace(callback)},
+	}
+	_, err = controllerutil.CreateOrUpdate(ctx, r.Client, policy, func() error {
+		policy.Labels = map[string]string{
+			erinnerungv1alpha1.CallbackUIDLabel:  string(callback.GetUID()),
+			erinnerungv1alpha1.CallbackNameLabel: labelValue(callback.GetName()),
+		}
+		policy.Spec = networkingv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{
+				MatchLabels: map[string]string{erinnerungv1alpha1.CallbackUIDLabel: string(callback.GetUID())},
+			},
+			PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeIngress, networkingv1.PolicyTypeEgress},
+			Egress:      egress,
+		}
+
+		return ctrl.SetControllerReference(callback, policy, r.Scheme)
+	})
+
+	return err
+}
+
+// jobPinnedAddress returns the address the sender Job is pinned to, in curl's --resolve format.
+func jobPinnedAddress(job *kbatch.Job) string {
+	for _, c := range job.Spec.Template.Spec.Containers {
+		if c.Name != senderContainerName {
+			continue
+		}
+		for _, e := range c.Env {
+			if e.Name == "CALLBACK_RESOLVE" {
+				return e.Value
+			}
+		}
+	}
+
+	return ""
+}
+
+// senderEgressRules returns the egress rules of the sender pods: an ipBlock per pinned address of resolves, by port,
+// or the target port of the referenced in-cluster Service in its namespace if there are no pinned addresses.
+func (r *CallbackUrlReconciler) senderEgressRules(callback erinnerungv1alpha1.Callback, targetURL string, resolves []string, svc *corev1.Service) ([]networkingv1.NetworkPolicyEgressRule, error) {
+	u, err := url.Parse(targetURL)
+	if err != nil {
+		return nil, err
+	}
+	host, _, err := erinnerungv1alpha1.URLHostPort(u)
+	if err != nil {
+		return nil, err
+	}
+	tcp := corev1.ProtocolTCP
+	udp := corev1.ProtocolUDP
+
+	// in-cluster Services are resolved by the cluster DNS, and the NetworkPolicy applies to the port of their pods
+	if len(resolves) == 0 {
+		ref := callback.CallbackSpec().ServiceRef
+		if ref == nil || svc == nil {
+			return nil, fmt.Errorf("no address to restrict the egress of %s to", host)
+		}
+		targetPort, ok := serviceTargetPort(svc, ref.Port)
+		if !ok {
+			return nil, fmt.Errorf("the Service %s/%s has no port %d", svc.Namespace, svc.Name, ref.Port)
+		}
+		dnsPort := intstr.FromInt(53)
+
+		return []networkingv1.NetworkPolicyEgressRule{
+			{
+				Ports: []networkingv1.NetworkPolicyPort{{Protocol: &tcp, Port: &targetPort}},
+				To: []networkingv1.NetworkPolicyPeer{{
+					NamespaceSelector: &metav1.LabelSelector{
+						MatchLabels: map[string]string{corev1.LabelMetadataName: svc.Namespace},
+					},
+				}},
+			},
+			{
+				Ports: []networkingv1.NetworkPolicyPort{{Protocol: &udp, Port: &dnsPort}, {Protocol: &tcp, Port: &dnsPort}},
+				To: []networkingv1.NetworkPolicyPeer{{
+					NamespaceSelector: &metav1.LabelSelector{
+						MatchLabels: map[string]string{corev1.LabelMetadataName: metav1.NamespaceSystem},
+					},
+					PodSelector: &metav1.LabelSelector{MatchLabels: clusterDNSLabels},
+				}},
+			},
+		}, nil
+	}
+
+	// the CIDRs by port, sorted so the NetworkPolicy is only updated if the addresses change
+	cidrs := map[int]map[string]bool{}
+	for _, resolve := range resolves {
+		port, ip, err := parseResolve(resolve)
+		if err != nil {
+			return nil, err
+		}
+		cidr := ip.String() + "/32"
+		if ip.To4() == nil {
+			cidr = ip.String() + "/128"
+		}
+		if cidrs[port] == nil {
+			cidrs[port] = map[string]bool{}
+		}
+		cidrs[port][cidr] = true
+	}
+	ports := make([]int, 0, len(cidrs))
+	for port := range cidrs {
+		ports = append(ports, port)
+	}
+	sort.Ints(ports)
+
+	egress := make([]networkingv1.NetworkPolicyEgressRule, 0, len(ports))
+	for _, port := range ports {
+		blocks := make([]string, 0, len(cidrs[port]))
+		for cidr := range cidrs[port] {
+			blocks = append(blocks, cidr)
+		}
+		sort.Strings(blocks)
+
+		targetPort := intstr.FromInt(port)
+		rule := networkingv1.NetworkPolicyEgressRule{
+			Ports: []networkingv1.NetworkPolicyPort{{Protocol: &tcp, Port: &targetPort}},
+		}
+		for _, cidr := range blocks {
+			rule.To = append(rule.To, networkingv1.NetworkPolicyPeer{IPBlock: &networkingv1.IPBlock{CIDR: cidr}})
+		}
+		egress = append(egress, rule)
+	}
+
+	return egress, nil
+}
+
+// serviceTargetPort returns the port of the Service's pods the Service port forwards to, by number or by name.
+func serviceTargetPort(svc *corev1.Service, port int32) (intstr.IntOrString, bool) {
+	for _, p := range svc.Spec.Ports {
+		if p.Port != port {
+			continue
+		}
+		if p.TargetPort.Type == intstr.Int && p.TargetPort.IntVal == 0 {
+			return intstr.FromInt(int(port)), true
+		}
+		return p.TargetPort, true
+	}
+
+	return intstr.IntOrString{}, false
+}
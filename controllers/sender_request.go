@@ -0,0 +1,226 @@
+/*
+Copyright (C) 2022 Christoph Görn
+
+This file is part of r-gespraech.
+
+r-gespraech is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+r-gespraech is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with r-gespraech.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	kbatch "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	erinnerungv1alpha1 "github.com/goern/r-gespraech/api/v1alpha1"
+)
+
+const (
+	// requestVolume is the volume of the request Secret, mounted read-only at requestMountPath.
+	requestVolume    = "request"
+	requestMountPath = "/etc/erinnerung/request"
+
+	// requestBodyKey is the request body, the data of the CallbackPayload.
+	requestBodyKey = "body"
+	// requestHeadersKey are the request headers, one "Name: value" per line, as read by `curl -H @file`.
+	requestHeadersKey = "headers"
+	// requestDocumentKey is the data of the CallbackPayload, kept for the OnUpdate policy deliverPatch.
+	requestDocumentKey = "document"
+
+	jsonContentType       = "application/json"
+	mergePatchContentType = "application/merge-patch+json"
+)
+
+// constructRequestSecret returns the Secret holding the rendered request of the sender Job, so the payload does not
+// appear in the Job spec. It has the name of the Job and is owned by the callback until the Job is created. The
+// previous Job is the latest complete delivery of the payload, a patch is created from its document. The request is
+// signed for the target if signing is enabled.
+func (r *CallbackUrlReconciler) constructRequestSecret(ctx context.Context, callback erinnerungv1alpha1.Callback, p *erinnerungv1alpha1.CallbackPayload, job, previous *kbatch.Job, targetURL string) (*corev1.Secret, error) {
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      job.Name,
+			Namespace: job.Namespace,
+			Labels: map[string]string{
+				erinnerungv1alpha1.PayloadUIDLabel:  string(p.UID),
+				erinnerungv1alpha1.CallbackUIDLabel: string(callback.GetUID()),
+			},
+		},
+		Type: corev1.SecretTypeOpaque,
+		Data: renderRequest(p),
+	}
+
+	contentType := jsonContentType
+	if r.onUpdate(callback) == erinnerungv1alpha1.OnUpdateDeliverPatch {
+		// keep the document the next patch is created from
+		secret.Data[requestDocumentKey] = []byte(p.Spec.Data)
+
+		if previous != nil {
+			patch, err := r.createPatch(ctx, previous, p.Spec.Data)
+			if err != nil {
+				return nil, err
+			}
+			if patch != nil {
+				contentType = mergePatchContentType
+				secret.Data[requestBodyKey] = patch
+				secret.Data[requestHeadersKey] = []byte("Content-Type: " + contentType + "\n")
+			}
+		}
+	}
+
+	// the delivery headers are not part of the content hash, they differ for every payload and attempt
+	secret.Data[requestHeadersKey] = append(secret.Data[requestHeadersKey], r.deliveryHeaders(callback, job)...)
+	signature, err := r.signatureHeaders(ctx, targetURL, r.idempotencyKeyHeader(callback), job.Annotations[erinnerungv1alpha1.DeliveryIDAnnotation],
+		contentType, secret.Data[requestBodyKey])
+	if err != nil {
+		return nil, err
+	}
+	secret.Data[requestHeadersKey] = append(secret.Data[requestHeadersKey], signature...)
+
+	if err := controllerutil.SetOwnerReference(callback, secret, r.Scheme); err != nil {
+		return nil, err
+	}
+
+	return secret, nil
+}
+
+// idempotencyKeyHeader returns the name of the request header carrying the delivery ID.
+func (r *CallbackUrlReconciler) idempotencyKeyHeader(callback erinnerungv1alpha1.Callback) string {
+	if header := callback.CallbackSpec().IdempotencyKeyHeader; header != "" {
+		return header
+	}
+	if r.IdempotencyKeyHeader != "" {
+		return r.IdempotencyKeyHeader
+	}
+	return erinnerungv1alpha1.DefaultIdempotencyKeyHeader
+}
+
+// deliveryHeaders returns the request headers identifying the delivery attempt of the sender Job.
+func (r *CallbackUrlReconciler) deliveryHeaders(callback erinnerungv1alpha1.Callback, job *kbatch.Job) []byte {
+	return []byte(fmt.Sprintf("%s: %s\n%s: %d\n",
+		r.idempotencyKeyHeader(callback), job.Annotations[erinnerungv1alpha1.DeliveryIDAnnotation],
+		erinnerungv1alpha1.AttemptHeader, jobDeliveryAttempt(job)))
+}
+
+// createPatch returns a JSON merge patch from the document delivered by the previous Job to the data, or nil if the
+// document is gone or either of them is not a JSON object. The Secrets are read from the API server, they are not
+// cached.
+func (r *CallbackUrlReconciler) createPatch(ctx context.Context, previous *kbatch.Job, data string) ([]byte, error) {
+	reader := r.APIReader
+	if reader == nil {
+		reader = r.Client
+	}
+
+	var secret corev1.Secret
+	if err := reader.Get(ctx, client.ObjectKeyFromObject(previous), &secret); err != nil {
+		return nil, client.IgnoreNotFound(err)
+	}
+	document, ok := secret.Data[requestDocumentKey]
+	if !ok || !isJSONObject(document) || !isJSONObject([]byte(data)) {
+		return nil, nil
+	}
+
+	patch, err := jsonpatch.CreateMergePatch(document, []byte(data))
+	if err != nil {
+		return nil, nil
+	}
+
+	return patch, nil
+}
+
+func isJSONObject(data []byte) bool {
+	var object map[string]interface{}
+	return json.Unmarshal(data, &object) == nil
+}
+
+// renderRequest returns the rendered request delivering the payload, its body and headers.
+func renderRequest(p *erinnerungv1alpha1.CallbackPayload) map[string][]byte {
+	return map[string][]byte{
+		requestBodyKey:    []byte(p.Spec.Data),
+		requestHeadersKey: []byte("Content-Type: " + jsonContentType + "\n"),
+	}
+}
+
+// requestHash returns the content hash of a rendered request.
+func requestHash(request map[string][]byte) string {
+	h := sha256.New()
+	h.Write(request[requestHeadersKey])
+	h.Write([]byte{0})
+	h.Write(request[requestBodyKey])
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// createRequestSecret creates the request Secret of the sender Job before the Job itself, a Job never exists without
+// its request. An existing Secret is kept, its name is deterministic for the delivery attempt.
+func (r *CallbackUrlReconciler) createRequestSecret(ctx context.Context, secret *corev1.Secret) (bool, error) {
+	if err := r.Create(ctx, secret); err != nil {
+		if errors.IsAlreadyExists(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, nil
+}
+
+// adoptRequestSecret hands the ownership of the request Secret over to the sender Job, so it is garbage collected
+// with the Job.
+func (r *CallbackUrlReconciler) adoptRequestSecret(ctx context.Context, secret *corev1.Secret, job *kbatch.Job) error {
+	if err := controllerutil.SetControllerReference(job, secret, r.Scheme); err != nil {
+		return err
+	}
+
+	return r.Update(ctx, secret)
+}
+
+// deleteRequestSecret deletes the request Secret of a finished sender Job.
+func (r *CallbackUrlReconciler) deleteRequestSecret(ctx context.Context, job *kbatch.Job) error {
+	secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: job.Name, Namespace: job.Namespace}}
+
+	return client.IgnoreNotFound(r.Delete(ctx, secret))
+}
+
+// mountRequestSecret mounts the request Secret read-only into the sender container.
+func mountRequestSecret(spec *corev1.PodSpec, name string) {
+	spec.Volumes = append(spec.Volumes, corev1.Volume{
+		Name: requestVolume,
+		VolumeSource: corev1.VolumeSource{
+			Secret: &corev1.SecretVolumeSource{
+				SecretName: name,
+				// readable by the group of the pod's fsGroup only
+				DefaultMode: pointer.Int32(0440),
+			},
+		},
+	})
+
+	sender := senderContainer(spec)
+	sender.VolumeMounts = append(sender.VolumeMounts, corev1.VolumeMount{
+		Name:      requestVolume,
+		MountPath: requestMountPath,
+		ReadOnly:  true,
+	})
+	sender.Env = mergeEnv(sender.Env, []corev1.EnvVar{{Name: "CALLBACK_REQUEST", Value: requestMountPath}})
+}
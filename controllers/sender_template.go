@@ -0,0 +1,224 @@
+/*
+Copyright (C) 2022 Christoph Görn
+
+This file is part of r-gespraech.
+
+r-gespraech is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+r-gespraech is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with r-gespraech.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	"k8s.io/utils/pointer"
+
+	erinnerungv1alpha1 "github.com/goern/r-gespraech/api/v1alpha1"
+)
+
+const (
+	senderContainerName = erinnerungv1alpha1.SenderContainerName
+	defaultSenderImage  = "registry.access.redhat.com/ubi9/ubi-minimal:9.0.0-1471"
+	// defaultSenderUser is the non-root user the sender runs as, unless a senderTemplate sets another one.
+	defaultSenderUser = 65532
+	senderTmpVolume   = "tmp"
+)
+
+// senderPodTemplate returns the pod template of the sender Jobs of the callback: the operator's defaults, merged
+// strategically with the senderTemplate of the ErinnerungConfig and then with the one of the callback, restricted for
+// CallbackUrls. The fields required by the operator, the sender container's command and env and the restart policy,
+// are set last.
+func (r *CallbackUrlReconciler) senderPodTemplate(callback erinnerungv1alpha1.Callback, env []corev1.EnvVar) (corev1.PodTemplateSpec, error) {
+	template := corev1.PodTemplateSpec{
+		Spec: corev1.PodSpec{
+			SecurityContext: &corev1.PodSecurityContext{
+				RunAsUser: pointer.Int64(defaultSenderUser),
+				// the group the request Secret is readable by
+				FSGroup: pointer.Int64(defaultSenderUser),
+			},
+			Containers: []corev1.Container{
+				{
+					Name:  senderContainerName,
+					Image: defaultSenderImage,
+				},
+			},
+		},
+	}
+
+	overlays := []*corev1.PodTemplateSpec{r.SenderTemplate, callback.CallbackSpec().SenderTemplate}
+	if callback.GetNamespace() != "" {
+		// the webhook rejects any other field, unless it is disabled
+		overlays[1] = erinnerungv1alpha1.RestrictSenderTemplate(overlays[1])
+	}
+	for _, overlay := range overlays {
+		if overlay == nil {
+			continue
+		}
+		merged, err := mergePodTemplate(template, overlay)
+		if err != nil {
+			return template, fmt.Errorf("unable to merge the senderTemplate: %w", err)
+		}
+		template = merged
+	}
+
+	sender := senderContainer(&template.Spec)
+	sender.Command = []string{
+		"sleep",
+		"180",
+	}
+	sender.Env = mergeEnv(sender.Env, env)
+	// the sender writes a JSON summary of the HTTP result as its termination message
+	sender.TerminationMessagePath = corev1.TerminationMessagePathDefault
+	sender.TerminationMessagePolicy = corev1.TerminationMessageFallbackToLogsOnError
+	template.Spec.RestartPolicy = corev1.RestartPolicyNever
+	if err := restrictPodSpec(&template.Spec); err != nil {
+		return template, err
+	}
+
+	return template, nil
+}
+
+// restrictPodSpec makes the pod spec comply with the restricted Pod Security Standard, whatever the senderTemplates
+// set: all (init) containers run as non-root with a read-only root filesystem and without any capabilities, the pod shares
+// no host namespaces, and the service account token is not mounted. Only emptyDir and Secret volumes may be used, a
+// writable /tmp is provided by an emptyDir.
+func restrictPodSpec(spec *corev1.PodSpec) error {
+	spec.AutomountServiceAccountToken = pointer.Bool(false)
+	spec.HostNetwork = false
+	spec.HostPID = false
+	spec.HostIPC = false
+
+	if spec.SecurityContext == nil {
+		spec.SecurityContext = &corev1.PodSecurityContext{}
+	}
+	spec.SecurityContext.RunAsNonRoot = pointer.Bool(true)
+	if spec.SecurityContext.SeccompProfile == nil || spec.SecurityContext.SeccompProfile.Type == corev1.SeccompProfileTypeUnconfined {
+		spec.SecurityContext.SeccompProfile = &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeRuntimeDefault}
+	}
+
+	hasTmp := false
+	for _, v := range spec.Volumes {
+		if v.EmptyDir == nil && v.Secret == nil {
+			return fmt.Errorf("the volume %s of the senderTemplate is neither an emptyDir nor a Secret", v.Name)
+		}
+		if v.Name == senderTmpVolume {
+			hasTmp = true
+		}
+	}
+	if !hasTmp {
+		spec.Volumes = append(spec.Volumes, corev1.Volume{
+			Name:         senderTmpVolume,
+			VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+		})
+	}
+
+	for i := range spec.InitContainers {
+		restrictContainer(&spec.InitContainers[i])
+	}
+	// ephemeral containers are added to running pods only, they are not part of a pod template
+	spec.EphemeralContainers = nil
+	for i := range spec.Containers {
+		c := &spec.Containers[i]
+		restrictContainer(c)
+
+		if c.Name == senderContainerName {
+			mounted := false
+			for _, m := range c.VolumeMounts {
+				if m.MountPath == "/tmp" {
+					mounted = true
+				}
+			}
+			if !mounted {
+				c.VolumeMounts = append(c.VolumeMounts, corev1.VolumeMount{Name: senderTmpVolume, MountPath: "/tmp"})
+			}
+		}
+	}
+
+	return nil
+}
+
+// restrictContainer sets the restricted security context of a container, and removes its host ports.
+func restrictContainer(c *corev1.Container) {
+	if c.SecurityContext == nil {
+		c.SecurityContext = &corev1.SecurityContext{}
+	}
+	c.SecurityContext.Privileged = pointer.Bool(false)
+	c.SecurityContext.AllowPrivilegeEscalation = pointer.Bool(false)
+	c.SecurityContext.ReadOnlyRootFilesystem = pointer.Bool(true)
+	c.SecurityContext.RunAsNonRoot = pointer.Bool(true)
+	c.SecurityContext.Capabilities = &corev1.Capabilities{Drop: []corev1.Capability{"ALL"}}
+	if c.SecurityContext.SeccompProfile != nil && c.SecurityContext.SeccompProfile.Type == corev1.SeccompProfileTypeUnconfined {
+		c.SecurityContext.SeccompProfile = nil
+	}
+
+	for i := range c.Ports {
+		c.Ports[i].HostPort = 0
+		c.Ports[i].HostIP = ""
+	}
+}
+
+// mergePodTemplate merges the overlay into the pod template with the strategic merge patch semantics of kubectl, e.g.
+// containers are merged by name.
+func mergePodTemplate(template corev1.PodTemplateSpec, overlay *corev1.PodTemplateSpec) (corev1.PodTemplateSpec, error) {
+	var merged corev1.PodTemplateSpec
+
+	original, err := json.Marshal(template)
+	if err != nil {
+		return merged, err
+	}
+	patch, err := json.Marshal(overlay)
+	if err != nil {
+		return merged, err
+	}
+
+	result, err := strategicpatch.StrategicMergePatch(original, patch, corev1.PodTemplateSpec{})
+	if err != nil {
+		return merged, err
+	}
+	err = json.Unmarshal(result, &merged)
+
+	return merged, err
+}
+
+// senderContainer returns the sender container of the pod spec, adding it if a template has replaced it.
+func senderContainer(spec *corev1.PodSpec) *corev1.Container {
+	for i := range spec.Containers {
+		if spec.Containers[i].Name == senderContainerName {
+			return &spec.Containers[i]
+		}
+	}
+
+	spec.Containers = append(spec.Containers, corev1.Container{Name: senderContainerName, Image: defaultSenderImage})
+	return &spec.Containers[len(spec.Containers)-1]
+}
+
+// mergeEnv sets the required env vars, replacing the ones of the same name.
+func mergeEnv(env []corev1.EnvVar, required []corev1.EnvVar) []corev1.EnvVar {
+	names := make(map[string]bool, len(required))
+	for _, e := range required {
+		names[e.Name] = true
+	}
+
+	result := make([]corev1.EnvVar, 0, len(env)+len(required))
+	for _, e := range env {
+		if !names[e.Name] {
+			result = append(result, e)
+		}
+	}
+
+	return append(result, required...)
+}
@@ -0,0 +1,244 @@
+/*
+Copyright (C) 2022 Christoph Görn
+
+This file is part of r-gespraech.
+
+r-gespraech is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+r-gespraech is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with r-gespraech.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package controllers
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/goern/r-gespraech/api/v1alpha1"
+)
+
+var _ = Describe("Sender pod template", func() {
+	env := []corev1.EnvVar{{Name: "CALLBACK_URL", Value: "https://localhost.local:8181/webhook/xyz_callback"}}
+
+	It("Should use the operator's defaults without a senderTemplate", func() {
+		r := &CallbackUrlReconciler{}
+		template, err := r.senderPodTemplate(generateCallbackUrl("abc123", "default", ""), env)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(template.Spec.Containers).To(HaveLen(1))
+		Expect(template.Spec.Containers[0].Image).To(Equal(defaultSenderImage))
+		Expect(template.Spec.RestartPolicy).To(Equal(corev1.RestartPolicyNever))
+	})
+
+	It("Should comply with the restricted Pod Security Standard, whatever the senderTemplate sets", func() {
+		privileged := true
+		r := &CallbackUrlReconciler{SenderTemplate: &corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{
+				Name:            senderContainerName,
+				SecurityContext: &corev1.SecurityContext{Privileged: &privileged},
+			}},
+		}}}
+		template, err := r.senderPodTemplate(generateCallbackUrl("abc123", "default", ""), env)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(*template.Spec.AutomountServiceAccountToken).To(BeFalse())
+		Expect(*template.Spec.SecurityContext.RunAsNonRoot).To(BeTrue())
+		Expect(template.Spec.SecurityContext.SeccompProfile.Type).To(Equal(corev1.SeccompProfileTypeRuntimeDefault))
+		sender := template.Spec.Containers[0]
+		Expect(*sender.SecurityContext.Privileged).To(BeFalse())
+		Expect(*sender.SecurityContext.AllowPrivilegeEscalation).To(BeFalse())
+		Expect(*sender.SecurityContext.ReadOnlyRootFilesystem).To(BeTrue())
+		Expect(sender.SecurityContext.Capabilities.Drop).To(ConsistOf(corev1.Capability("ALL")))
+		Expect(sender.VolumeMounts).To(ContainElement(corev1.VolumeMount{Name: senderTmpVolume, MountPath: "/tmp"}))
+	})
+
+	It("Should harden the init containers and share no host namespaces", func() {
+		privileged := true
+		r := &CallbackUrlReconciler{SenderTemplate: &corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+			HostNetwork: true,
+			HostPID:     true,
+			HostIPC:     true,
+			InitContainers: []corev1.Container{{
+				Name:            "init",
+				SecurityContext: &corev1.SecurityContext{Privileged: &privileged},
+				Ports:           []corev1.ContainerPort{{ContainerPort: 8080, HostPort: 8080}},
+			}},
+		}}}
+		template, err := r.senderPodTemplate(generateCallbackUrl("abc123", "default", ""), env)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(template.Spec.HostNetwork).To(BeFalse())
+		Expect(template.Spec.HostPID).To(BeFalse())
+		Expect(template.Spec.HostIPC).To(BeFalse())
+		init := template.Spec.InitContainers[0]
+		Expect(*init.SecurityContext.Privileged).To(BeFalse())
+		Expect(*init.SecurityContext.RunAsNonRoot).To(BeTrue())
+		Expect(init.SecurityContext.Capabilities.Drop).To(ConsistOf(corev1.Capability("ALL")))
+		Expect(init.Ports[0].HostPort).To(BeZero())
+	})
+
+	It("Should reject volumes other than emptyDir and Secret", func() {
+		r := &CallbackUrlReconciler{SenderTemplate: &corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+			Volumes: []corev1.Volume{{Name: "host", VolumeSource: corev1.VolumeSource{HostPath: &corev1.HostPathVolumeSource{Path: "/"}}}},
+		}}}
+		_, err := r.senderPodTemplate(generateCallbackUrl("abc123", "default", ""), env)
+		Expect(err).To(HaveOccurred())
+
+		r.SenderTemplate.Spec.Volumes[0].VolumeSource = corev1.VolumeSource{Secret: &corev1.SecretVolumeSource{SecretName: "ca-bundle"}}
+		_, err = r.senderPodTemplate(generateCallbackUrl("abc123", "default", ""), env)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("Should merge the senderTemplates of the ErinnerungConfig and the CallbackUrl", func() {
+		r := &CallbackUrlReconciler{SenderTemplate: &corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+			NodeSelector: map[string]string{"node-pool": "egress"},
+			Containers: []corev1.Container{{
+				Name:  senderContainerName,
+				Image: "mirror.example.com/ubi9/ubi-minimal:9.0.0-1471",
+				Env:   []corev1.EnvVar{{Name: "CALLBACK_URL", Value: "https://example.com"}, {Name: "HTTPS_PROXY", Value: "http://proxy:3128"}},
+			}},
+			RestartPolicy: corev1.RestartPolicyAlways,
+		}}}
+		callbackUrl := generateCallbackUrl("abc123", "default", "")
+		callbackUrl.Spec.SenderTemplate = &corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{
+				Name: senderContainerName,
+				Resources: corev1.ResourceRequirements{
+					Limits: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("100m")},
+				},
+			}},
+		}}
+
+		template, err := r.senderPodTemplate(callbackUrl, env)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(template.Spec.NodeSelector).To(HaveKeyWithValue("node-pool", "egress"))
+		Expect(template.Spec.Containers).To(HaveLen(1))
+		sender := template.Spec.Containers[0]
+		Expect(sender.Image).To(Equal("mirror.example.com/ubi9/ubi-minimal:9.0.0-1471"))
+		Expect(sender.Resources.Limits.Cpu().String()).To(Equal("100m"))
+		Expect(*template.Spec.SecurityContext.RunAsUser).To(Equal(int64(defaultSenderUser)))
+		Expect(sender.Env).To(ConsistOf(
+			corev1.EnvVar{Name: "HTTPS_PROXY", Value: "http://proxy:3128"},
+			env[0],
+		))
+		Expect(template.Spec.RestartPolicy).To(Equal(corev1.RestartPolicyNever))
+	})
+
+	It("Should only take the image, resources, nodeSelector and tolerations from a CallbackUrl", func() {
+		r := &CallbackUrlReconciler{}
+		callbackUrl := generateCallbackUrl("abc123", "default", "")
+		callbackUrl.Spec.SenderTemplate = &corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+			ServiceAccountName: "cluster-admin",
+			NodeSelector:       map[string]string{"node-pool": "egress"},
+			InitContainers:     []corev1.Container{{Name: "init", Image: "example.com/init"}},
+			Containers: []corev1.Container{
+				{Name: senderContainerName, Image: "example.com/sender", Command: []string{"sh"}},
+				{Name: "sidecar", Image: "example.com/sidecar"},
+			},
+		}}
+
+		template, err := r.senderPodTemplate(callbackUrl, env)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(template.Spec.ServiceAccountName).To(BeEmpty())
+		Expect(template.Spec.InitContainers).To(BeEmpty())
+		Expect(template.Spec.NodeSelector).To(HaveKeyWithValue("node-pool", "egress"))
+		Expect(template.Spec.Containers).To(HaveLen(1))
+		Expect(template.Spec.Containers[0].Image).To(Equal("example.com/sender"))
+		Expect(template.Spec.Containers[0].Command).To(Equal([]string{"sleep", "180"}))
+	})
+})
+
+var _ = Describe("Sender NetworkPolicy", func() {
+	It("Should limit the egress to the pinned address and port of the target", func() {
+		r := &CallbackUrlReconciler{}
+		egress, err := r.senderEgressRules(generateCallbackUrl("abc123", "default", ""), "https://localhost.local:8181/webhook", []string{"localhost.local:8181:127.0.0.1"}, nil)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(egress).To(HaveLen(1))
+		Expect(egress[0].To[0].IPBlock.CIDR).To(Equal("127.0.0.1/32"))
+		Expect(egress[0].Ports[0].Port.IntValue()).To(Equal(8181))
+	})
+
+	It("Should allow every address of the target, and the addresses the running Jobs are pinned to", func() {
+		r := &CallbackUrlReconciler{}
+		egress, err := r.senderEgressRules(generateCallbackUrl("abc123", "default", ""), "https://example.com/webhook", []string{
+			"example.com:443:203.0.113.2",
+			"example.com:443:[2001:db8::1]",
+			"example.com:443:203.0.113.1",
+			// a Job pinned before the target moved to another port
+			"example.com:8443:203.0.113.1",
+		}, nil)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(egress).To(HaveLen(2))
+		Expect(egress[0].Ports[0].Port.IntValue()).To(Equal(443))
+		Expect(egress[0].To).To(HaveLen(3))
+		Expect(egress[0].To[0].IPBlock.CIDR).To(Equal("2001:db8::1/128"))
+		Expect(egress[0].To[1].IPBlock.CIDR).To(Equal("203.0.113.1/32"))
+		Expect(egress[1].Ports[0].Port.IntValue()).To(Equal(8443))
+	})
+
+	It("Should pin the same address whatever order the addresses resolve in", func() {
+		callbackURL := "https://example.com/webhook"
+		r := &CallbackUrlReconciler{
+			EgressPolicy: &v1alpha1.EgressPolicy{DeniedCIDRs: []string{"10.0.0.0/8"}},
+			Resolver:     staticResolver{"203.0.113.2", "203.0.113.1"},
+		}
+		pinned, allowed, err := r.checkEgress(ctx, callbackURL)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pinned).To(Equal("example.com:443:203.0.113.1"))
+		Expect(allowed).To(Equal([]string{"example.com:443:203.0.113.1", "example.com:443:203.0.113.2"}))
+
+		r.Resolver = staticResolver{"203.0.113.1", "203.0.113.2"}
+		pinned, _, err = r.checkEgress(ctx, callbackURL)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pinned).To(Equal("example.com:443:203.0.113.1"))
+	})
+
+	It("Should limit the egress to the target port of an in-cluster Service and the cluster DNS", func() {
+		r := &CallbackUrlReconciler{}
+		callbackUrl := generateCallbackUrl("abc123", "receivers", "")
+		callbackUrl.Spec.ServiceRef = &v1alpha1.ServiceReference{Name: "receiver", Port: 8080}
+		svc := &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "receiver", Namespace: "receivers"},
+			Spec: corev1.ServiceSpec{Ports: []corev1.ServicePort{
+				{Name: "metrics", Port: 9090, TargetPort: intstr.FromInt(9090)},
+				{Name: "http", Port: 8080, TargetPort: intstr.FromString("http")},
+			}},
+		}
+		egress, err := r.senderEgressRules(callbackUrl, "http://receiver.receivers.svc:8080/", nil, svc)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(egress).To(HaveLen(2))
+
+		Expect(egress[0].To[0].NamespaceSelector.MatchLabels).To(HaveKeyWithValue(corev1.LabelMetadataName, "receivers"))
+		Expect(egress[0].Ports).To(HaveLen(1))
+		Expect(*egress[0].Ports[0].Port).To(Equal(intstr.FromString("http")))
+
+		By("By allowing DNS to the cluster DNS pods only")
+		Expect(egress[1].To).To(HaveLen(1))
+		Expect(egress[1].To[0].NamespaceSelector.MatchLabels).To(HaveKeyWithValue(corev1.LabelMetadataName, "kube-system"))
+		Expect(egress[1].To[0].PodSelector.MatchLabels).To(HaveKeyWithValue("k8s-app", "kube-dns"))
+
+		By("By defaulting the target port to the Service port")
+		svc.Spec.Ports[1].TargetPort = intstr.IntOrString{}
+		egress, err = r.senderEgressRules(callbackUrl, "http://receiver.receivers.svc:8080/", nil, svc)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(*egress[0].Ports[0].Port).To(Equal(intstr.FromInt(8080)))
+	})
+})
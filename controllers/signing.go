@@ -0,0 +1,316 @@
+/*
+Copyright (C) 2022 Christoph Görn
+
+This file is part of r-gespraech.
+
+r-gespraech is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+r-gespraech is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with r-gespraech.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	erinnerungv1alpha1 "github.com/goern/r-gespraech/api/v1alpha1"
+)
+
+const (
+	// keyringRefresh is the time the keys of the Keyring are cached, a rolled over key is used after at most as long.
+	keyringRefresh = time.Minute
+	// jwksPath is the path of the JWKS endpoint.
+	jwksPath = "/.well-known/jwks.json"
+)
+
+// signingKey is a private key signing the deliveries, identified by its key ID.
+type signingKey struct {
+	id  string
+	key crypto.Signer
+}
+
+// Keyring holds the keys signing the deliveries, read from a Secret. The Secret is read from the API server and
+// cached for keyringRefresh, the operator does not watch Secrets.
+type Keyring struct {
+	// Reader reads the Secret, e.g. the manager's APIReader.
+	Reader client.Reader
+	// Secret is the Secret holding the keys.
+	Secret types.NamespacedName
+
+	mu     sync.Mutex
+	loaded time.Time
+	keys   []signingKey
+	active *signingKey
+}
+
+// current returns all keys of the Keyring, and the one signing the deliveries.
+func (k *Keyring) current(ctx context.Context) ([]signingKey, *signingKey, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if !k.loaded.IsZero() && time.Since(k.loaded) < keyringRefresh {
+		return k.keys, k.active, nil
+	}
+
+	var secret corev1.Secret
+	if err := k.Reader.Get(ctx, k.Secret, &secret); err != nil {
+		return nil, nil, fmt.Errorf("unable to read the signing keys: %w", err)
+	}
+	keys, active, err := parseSigningKeys(&secret)
+	if err != nil {
+		return nil, nil, err
+	}
+	k.keys, k.active, k.loaded = keys, active, time.Now()
+
+	return keys, active, nil
+}
+
+// parseSigningKeys returns the keys of the Secret, sorted by their ID, and the one named by its SigningKeyAnnotation.
+// A Secret holding a single key does not need the annotation.
+func parseSigningKeys(secret *corev1.Secret) ([]signingKey, *signingKey, error) {
+	keys := make([]signingKey, 0, len(secret.Data))
+	for id, data := range secret.Data {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, nil, fmt.Errorf("the signing key %q is not PEM encoded", id)
+		}
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, nil, fmt.Errorf("the signing key %q is not a PKCS #8 private key: %w", id, err)
+		}
+		switch key := parsed.(type) {
+		case ed25519.PrivateKey:
+			keys = append(keys, signingKey{id: id, key: key})
+		case *rsa.PrivateKey:
+			keys = append(keys, signingKey{id: id, key: key})
+		default:
+			return nil, nil, fmt.Errorf("the signing key %q is neither an Ed25519 nor an RSA key", id)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].id < keys[j].id })
+
+	activeID := secret.Annotations[erinnerungv1alpha1.SigningKeyAnnotation]
+	if activeID == "" && len(keys) == 1 {
+		activeID = keys[0].id
+	}
+	for i := range keys {
+		if keys[i].id == activeID {
+			return keys, &keys[i], nil
+		}
+	}
+
+	return nil, nil, fmt.Errorf("the signing key %q is not in the Secret %s/%s", activeID, secret.Namespace, secret.Name)
+}
+
+// algorithms returns the JWS algorithm and the HTTP Message Signatures algorithm of the key.
+func (k *signingKey) algorithms() (string, string) {
+	if _, ok := k.key.(ed25519.PrivateKey); ok {
+		return "EdDSA", "ed25519"
+	}
+	return "RS256", "rsa-v1_5-sha256"
+}
+
+// sign signs the data, Ed25519 signs the data itself and RSA its SHA-256 digest with PKCS #1 v1.5.
+func (k *signingKey) sign(data []byte) ([]byte, error) {
+	if _, ok := k.key.(ed25519.PrivateKey); ok {
+		return k.key.Sign(rand.Reader, data, crypto.Hash(0))
+	}
+	digest := sha256.Sum256(data)
+	return k.key.Sign(rand.Reader, digest[:], crypto.SHA256)
+}
+
+// jwk is a public key in the JSON Web Key format (RFC 7517).
+type jwk struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	// Curve and X are the parameters of an Ed25519 key (RFC 8037).
+	Curve string `json:"crv,omitempty"`
+	X     string `json:"x,omitempty"`
+	// N and E are the parameters of an RSA key (RFC 7518).
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+}
+
+// publicJWK returns the public key of the key as JWK.
+func (k *signingKey) publicJWK() jwk {
+	alg, _ := k.algorithms()
+	key := jwk{KeyID: k.id, Use: "sig", Algorithm: alg}
+	switch public := k.key.Public().(type) {
+	case ed25519.PublicKey:
+		key.KeyType, key.Curve, key.X = "OKP", "Ed25519", base64.RawURLEncoding.EncodeToString(public)
+	case *rsa.PublicKey:
+		key.KeyType = "RSA"
+		key.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+		key.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+	}
+
+	return key
+}
+
+// ServeHTTP serves the public keys of the Keyring as JWK Set, including the keys not signing yet or anymore so
+// receivers can verify the deliveries while the keys are rolled over.
+func (k *Keyring) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	keys, _, err := k.current(req.Context())
+	if err != nil {
+		log.FromContext(req.Context()).Error(err, "unable to serve the JWKS")
+		http.Error(w, "the signing keys are not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	set := struct {
+		Keys []jwk `json:"keys"`
+	}{Keys: make([]jwk, 0, len(keys))}
+	for i := range keys {
+		set.Keys = append(set.Keys, keys[i].publicJWK())
+	}
+
+	w.Header().Set("Content-Type", "application/jwk-set+json")
+	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", int(keyringRefresh.Seconds())))
+	_ = json.NewEncoder(w).Encode(set)
+}
+
+// JWKSServer serves the public keys of a Keyring on every replica of the operator, it is added to the manager.
+type JWKSServer struct {
+	// Addr is the address the server binds to.
+	Addr    string
+	Keyring *Keyring
+}
+
+// Start serves the JWKS until the context is done.
+func (s *JWKSServer) Start(ctx context.Context) error {
+	mux := http.NewServeMux()
+	mux.Handle(jwksPath, s.Keyring)
+	server := &http.Server{Addr: s.Addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.ListenAndServe()
+	}()
+
+	select {
+	case <-ctx.Done():
+		shutdown, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		return server.Shutdown(shutdown)
+	case err := <-errs:
+		return err
+	}
+}
+
+// NeedLeaderElection tells the manager to serve the JWKS on every replica.
+func (s *JWKSServer) NeedLeaderElection() bool {
+	return false
+}
+
+// signatureHeaders returns the request headers signing the body of the delivery to the target, in the SigningFormat.
+// The deliveries are not signed without a Keyring.
+func (r *CallbackUrlReconciler) signatureHeaders(ctx context.Context, targetURL, idempotencyKeyHeader, deliveryID, contentType string, body []byte) ([]byte, error) {
+	if r.Keyring == nil {
+		return nil, nil
+	}
+	_, key, err := r.Keyring.current(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.SigningFormat == erinnerungv1alpha1.SigningFormatHTTPMessageSignatures {
+		return httpMessageSignature(key, targetURL, contentType, idempotencyKeyHeader, deliveryID, body, time.Now())
+	}
+	return detachedJWS(key, targetURL, deliveryID, body, time.Now())
+}
+
+// jwsHeader is the protected header of the detached JWS. Besides the key, it binds the signature to the target URI and
+// the delivery, and tells when it was issued, so a receiver can reject a delivery replayed to another receiver or later.
+type jwsHeader struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+	// TargetURI is the URI the body is delivered to.
+	TargetURI string `json:"htu"`
+	// DeliveryID is the ID of the delivery, sent in the idempotency key header as well.
+	DeliveryID string `json:"delivery_id"`
+	// IssuedAt is the time the delivery was signed, in seconds since the epoch.
+	IssuedAt int64 `json:"iat"`
+}
+
+// detachedJWS returns the header carrying the detached JWS of the body delivered to the target (RFC 7515, appendix F):
+// the compact serialization without its payload.
+func detachedJWS(key *signingKey, targetURL, deliveryID string, body []byte, issued time.Time) ([]byte, error) {
+	alg, _ := key.algorithms()
+	header, err := json.Marshal(jwsHeader{
+		Algorithm:  alg,
+		KeyID:      key.id,
+		TargetURI:  targetURL,
+		DeliveryID: deliveryID,
+		IssuedAt:   issued.Unix(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	protected := base64.RawURLEncoding.EncodeToString(header)
+	signature, err := key.sign([]byte(protected + "." + base64.RawURLEncoding.EncodeToString(body)))
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(fmt.Sprintf("%s: %s..%s\n", erinnerungv1alpha1.JWSSignatureHeader, protected, base64.RawURLEncoding.EncodeToString(signature))), nil
+}
+
+// httpMessageSignature returns the Content-Digest (RFC 9530), Signature-Input and Signature headers of HTTP Message
+// Signatures (RFC 9421), covering the method, the target URI, the content type, the digest of the body and the
+// idempotency key header. The delivery ID is the nonce of the signature as well, binding it to the delivery.
+func httpMessageSignature(key *signingKey, targetURL, contentType, idempotencyKeyHeader, deliveryID string, body []byte, created time.Time) ([]byte, error) {
+	_, alg := key.algorithms()
+	digest := sha256.Sum256(body)
+	contentDigest := "sha-256=:" + base64.StdEncoding.EncodeToString(digest[:]) + ":"
+	idempotencyKey := strings.ToLower(idempotencyKeyHeader)
+
+	params := `("@method" "@target-uri" "content-type" "content-digest" "` + idempotencyKey + `");created=` +
+		strconv.FormatInt(created.Unix(), 10) + `;nonce="` + deliveryID + `";keyid="` + key.id + `";alg="` + alg + `"`
+	base := `"@method": POST` + "\n" +
+		`"@target-uri": ` + targetURL + "\n" +
+		`"content-type": ` + contentType + "\n" +
+		`"content-digest": ` + contentDigest + "\n" +
+		`"` + idempotencyKey + `": ` + deliveryID + "\n" +
+		`"@signature-params": ` + params
+	signature, err := key.sign([]byte(base))
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(fmt.Sprintf("Content-Digest: %s\nSignature-Input: sig1=%s\nSignature: sig1=:%s:\n",
+		contentDigest, params, base64.StdEncoding.EncodeToString(signature))), nil
+}
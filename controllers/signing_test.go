@@ -0,0 +1,192 @@
+/*
+Copyright (C) 2022 Christoph Görn
+
+This file is part of r-gespraech.
+
+r-gespraech is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+r-gespraech is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with r-gespraech.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package controllers
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/goern/r-gespraech/api/v1alpha1"
+)
+
+func encodeSigningKey(key interface{}) []byte {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	Expect(err).NotTo(HaveOccurred())
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+}
+
+// verifyWithJWK verifies the signature of the data with the public key published in the JWKS, as a receiver would.
+func verifyWithJWK(key jwk, data, signature []byte) bool {
+	switch key.KeyType {
+	case "OKP":
+		x, err := base64.RawURLEncoding.DecodeString(key.X)
+		Expect(err).NotTo(HaveOccurred())
+		return ed25519.Verify(ed25519.PublicKey(x), data, signature)
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(key.N)
+		Expect(err).NotTo(HaveOccurred())
+		e, err := base64.RawURLEncoding.DecodeString(key.E)
+		Expect(err).NotTo(HaveOccurred())
+		public := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		digest := sha256.Sum256(data)
+		return rsa.VerifyPKCS1v15(public, crypto.SHA256, digest[:], signature) == nil
+	}
+	return false
+}
+
+// headerValue returns the value of the request header, one "Name: value" per line.
+func headerValue(headers []byte, name string) string {
+	for _, line := range strings.Split(string(headers), "\n") {
+		if strings.HasPrefix(line, name+": ") {
+			return strings.TrimPrefix(line, name+": ")
+		}
+	}
+	return ""
+}
+
+var _ = Describe("Delivery signatures", func() {
+	var (
+		edKey  ed25519.PrivateKey
+		rsaKey *rsa.PrivateKey
+		secret *corev1.Secret
+	)
+
+	BeforeEach(func() {
+		var err error
+		_, edKey, err = ed25519.GenerateKey(rand.Reader)
+		Expect(err).NotTo(HaveOccurred())
+		rsaKey, err = rsa.GenerateKey(rand.Reader, 2048)
+		Expect(err).NotTo(HaveOccurred())
+
+		secret = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{v1alpha1.SigningKeyAnnotation: "2022-06"}},
+			Data: map[string][]byte{
+				"2022-01": encodeSigningKey(rsaKey),
+				"2022-06": encodeSigningKey(edKey),
+			},
+		}
+	})
+
+	It("Should sign with the annotated key and publish all keys for the rollover", func() {
+		keys, active, err := parseSigningKeys(secret)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(active.id).To(Equal("2022-06"))
+
+		keyring := &Keyring{keys: keys, active: active, loaded: time.Now()}
+		recorder := httptest.NewRecorder()
+		keyring.ServeHTTP(recorder, httptest.NewRequest("GET", jwksPath, nil))
+
+		var set struct {
+			Keys []jwk `json:"keys"`
+		}
+		Expect(json.Unmarshal(recorder.Body.Bytes(), &set)).To(Succeed())
+		Expect(set.Keys).To(HaveLen(2))
+		Expect(set.Keys[0].KeyType).To(Equal("RSA"))
+		Expect(set.Keys[1].KeyType).To(Equal("OKP"))
+		Expect(set.Keys[1].X).To(Equal(base64.RawURLEncoding.EncodeToString(edKey.Public().(ed25519.PublicKey))))
+	})
+
+	It("Should reject a Secret without the annotated key", func() {
+		secret.Annotations[v1alpha1.SigningKeyAnnotation] = "2023-01"
+		_, _, err := parseSigningKeys(secret)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("Should send a detached JWS of the body, bound to the target and the delivery", func() {
+		keys, _, err := parseSigningKeys(secret)
+		Expect(err).NotTo(HaveOccurred())
+		body := []byte(`{"adviser-document-id": "abc123"}`)
+		targetURL := "https://localhost.local:8181/webhook/xyz_callback"
+
+		for i := range keys {
+			header, err := detachedJWS(&keys[i], targetURL, "0123", body, time.Unix(1655000000, 0))
+			Expect(err).NotTo(HaveOccurred())
+			parts := strings.Split(headerValue(header, v1alpha1.JWSSignatureHeader), ".")
+			Expect(parts).To(HaveLen(3))
+			Expect(parts[1]).To(BeEmpty())
+
+			protected, err := base64.RawURLEncoding.DecodeString(parts[0])
+			Expect(err).NotTo(HaveOccurred())
+			var decoded jwsHeader
+			Expect(json.Unmarshal(protected, &decoded)).To(Succeed())
+			Expect(decoded).To(Equal(jwsHeader{
+				Algorithm:  keys[i].publicJWK().Algorithm,
+				KeyID:      keys[i].id,
+				TargetURI:  targetURL,
+				DeliveryID: "0123",
+				IssuedAt:   1655000000,
+			}))
+
+			signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+			Expect(err).NotTo(HaveOccurred())
+			signed := parts[0] + "." + base64.RawURLEncoding.EncodeToString(body)
+			Expect(verifyWithJWK(keys[i].publicJWK(), []byte(signed), signature)).To(BeTrue())
+			Expect(verifyWithJWK(keys[i].publicJWK(), []byte(signed+"x"), signature)).To(BeFalse())
+		}
+	})
+
+	It("Should send HTTP Message Signatures covering the digest of the body and the delivery ID", func() {
+		keys, _, err := parseSigningKeys(secret)
+		Expect(err).NotTo(HaveOccurred())
+		targetURL := "https://localhost.local:8181/webhook/xyz_callback"
+
+		for i := range keys {
+			headers, err := httpMessageSignature(&keys[i], targetURL, jsonContentType, "Idempotency-Key", "0123", []byte("{}"), time.Unix(1655000000, 0))
+			Expect(err).NotTo(HaveOccurred())
+			contentDigest := headerValue(headers, "Content-Digest")
+			Expect(contentDigest).To(Equal("sha-256=:RBNvo1WzZ4oRRq0W9+hknpT7T8If536DEMBg9hyq/4o=:"))
+			_, alg := keys[i].algorithms()
+			params := strings.TrimPrefix(headerValue(headers, "Signature-Input"), "sig1=")
+			Expect(params).To(Equal(`("@method" "@target-uri" "content-type" "content-digest" "idempotency-key");created=1655000000;nonce="0123";keyid="` + keys[i].id + `";alg="` + alg + `"`))
+
+			By("By rebuilding the signature base as the receiver does")
+			base := `"@method": POST` + "\n" +
+				`"@target-uri": ` + targetURL + "\n" +
+				`"content-type": ` + jsonContentType + "\n" +
+				`"content-digest": ` + contentDigest + "\n" +
+				`"idempotency-key": 0123` + "\n" +
+				`"@signature-params": ` + params
+			value := headerValue(headers, "Signature")
+			Expect(value).To(HavePrefix("sig1=:"))
+			signature, err := base64.StdEncoding.DecodeString(strings.TrimSuffix(strings.TrimPrefix(value, "sig1=:"), ":"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(verifyWithJWK(keys[i].publicJWK(), []byte(base), signature)).To(BeTrue())
+			Expect(verifyWithJWK(keys[i].publicJWK(), []byte(strings.Replace(base, "POST", "PUT", 1)), signature)).To(BeFalse())
+			Expect(verifyWithJWK(keys[i].publicJWK(), []byte(strings.Replace(base, "idempotency-key\": 0123", "idempotency-key\": 4567", 1)), signature)).To(BeFalse())
+		}
+	})
+})
@@ -23,6 +23,7 @@ import (
 	"context"
 	"fmt"
 	"math/rand"
+	"net"
 	"path/filepath"
 	"testing"
 	"time"
@@ -93,12 +94,32 @@ var _ = BeforeSuite(func() {
 	})
 	Expect(err).ToNot(HaveOccurred())
 
-	err = (&CallbackUrlReconciler{
+	err = (&CallbackPayloadReconciler{
 		Client: k8sManager.GetClient(),
 		Scheme: k8sManager.GetScheme(),
 	}).SetupWithManager(k8sManager)
 	Expect(err).ToNot(HaveOccurred())
 
+	callbackUrlReconciler := CallbackUrlReconciler{
+		Client:    k8sManager.GetClient(),
+		Scheme:    k8sManager.GetScheme(),
+		APIReader: k8sManager.GetAPIReader(),
+		Recorder:  k8sManager.GetEventRecorderFor("callbackurl-controller"),
+		// the test CallbackUrls point to localhost.local
+		EgressPolicy:    &erinnerungv1alpha1.EgressPolicy{AllowedCIDRs: []string{"127.0.0.0/8"}},
+		Resolver:        staticResolver{"127.0.0.1"},
+		SenderNamespace: "default",
+		// reconcile in parallel, run the suite with `make test-race` to detect data races
+		MaxConcurrentReconciles: 4,
+	}
+	err = (&callbackUrlReconciler).SetupWithManager(k8sManager)
+	Expect(err).ToNot(HaveOccurred())
+
+	err = (&ClusterCallbackUrlReconciler{
+		CallbackUrlReconciler: callbackUrlReconciler,
+	}).SetupWithManager(k8sManager)
+	Expect(err).ToNot(HaveOccurred())
+
 	go func() {
 		defer GinkgoRecover()
 		err = k8sManager.Start(ctx)
@@ -113,6 +134,17 @@ var _ = AfterSuite(func() {
 	Expect(err).NotTo(HaveOccurred())
 })
 
+// staticResolver resolves every host to the same address.
+type staticResolver []string
+
+func (s staticResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	addrs := make([]net.IPAddr, len(s))
+	for i, a := range s {
+		addrs[i] = net.IPAddr{IP: net.ParseIP(a)}
+	}
+	return addrs, nil
+}
+
 func StringWithCharset(length int, charset string) string {
 	b := make([]byte, length)
 	for i := range b {
@@ -0,0 +1,64 @@
+/*
+Copyright (C) 2022 Christoph Görn
+
+This file is part of r-gespraech.
+
+r-gespraech is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+r-gespraech is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with r-gespraech.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	erinnerungv1alpha1 "github.com/goern/r-gespraech/api/v1alpha1"
+)
+
+// setSuspendedCondition reports if the callback is suspended. The reason of an automatic suspension is kept as long as
+// the callback is suspended.
+func setSuspendedCondition(callback erinnerungv1alpha1.Callback) {
+	conditions := &callback.CallbackStatus().Conditions
+	if !callback.CallbackSpec().Suspend {
+		meta.RemoveStatusCondition(conditions, erinnerungv1alpha1.Suspended)
+		return
+	}
+	if meta.IsStatusConditionTrue(*conditions, erinnerungv1alpha1.Suspended) {
+		return
+	}
+	setCondition(callback, erinnerungv1alpha1.Suspended, metav1.ConditionTrue, "Suspended", "the deliveries are suspended, the CallbackPayloads are kept")
+}
+
+// suspend sets the `suspend` field of the callback, as its receiver has been retired. Only the field is patched, the
+// status of the callback being reconciled is kept.
+func (r *CallbackUrlReconciler) suspend(ctx context.Context, callback erinnerungv1alpha1.Callback, reason, message string) error {
+	suspended := callback.DeepCopyObject().(erinnerungv1alpha1.Callback)
+	suspended.CallbackSpec().Suspend = true
+	if err := r.Patch(ctx, suspended, client.MergeFrom(callback)); err != nil {
+		return err
+	}
+
+	callback.CallbackSpec().Suspend = true
+	callback.SetResourceVersion(suspended.GetResourceVersion())
+	setCondition(callback, erinnerungv1alpha1.Suspended, metav1.ConditionTrue, reason, message)
+	if r.Recorder != nil {
+		r.Recorder.Event(callback, corev1.EventTypeWarning, "Suspended", message)
+	}
+
+	return nil
+}
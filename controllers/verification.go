@@ -0,0 +1,198 @@
+/*
+Copyright (C) 2022 Christoph Görn
+
+This file is part of r-gespraech.
+
+r-gespraech is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+r-gespraech is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with r-gespraech.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	erinnerungv1alpha1 "github.com/goern/r-gespraech/api/v1alpha1"
+)
+
+const (
+	// defaultVerificationInterval is the time between verifications of a verified receiver.
+	defaultVerificationInterval = 24 * time.Hour
+	// verificationRetryInterval is the time between verifications of a receiver that is not verified.
+	verificationRetryInterval = time.Minute
+	// verificationTimeout is the time a verification waits for the response of the receiver.
+	verificationTimeout = 10 * time.Second
+	// maxChallengeResponseLength is the length of the receiver's response read for the challenge.
+	maxChallengeResponseLength = 4096
+
+	// challengeType is the type of the verification request, telling it apart from a delivery.
+	challengeType = "url_verification"
+)
+
+// challengeRequest is the JSON body of the verification request, the receiver must echo the challenge either as the
+// plain response body or as the challenge of a JSON response.
+type challengeRequest struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+}
+
+// verified tells if the callback may deliver: it does not require a verification, or its receiver is verified.
+func verified(callback erinnerungv1alpha1.Callback) bool {
+	return callback.CallbackSpec().Verification == nil || meta.IsStatusConditionTrue(callback.CallbackStatus().Conditions, erinnerungv1alpha1.Verified)
+}
+
+// nextVerification returns the time until the next verification of the receiver is due.
+func nextVerification(callback erinnerungv1alpha1.Callback, now time.Time) (time.Duration, bool) {
+	verification := callback.CallbackSpec().Verification
+	if verification == nil {
+		return 0, false
+	}
+	last := callback.CallbackStatus().LastVerificationTime
+	if last == nil {
+		return 0, true
+	}
+
+	interval := verificationRetryInterval
+	if verified(callback) {
+		interval = defaultVerificationInterval
+		if verification.Interval != nil && verification.Interval.Duration > 0 {
+			interval = verification.Interval.Duration
+		}
+	}
+	if next := last.Add(interval).Sub(now); next > 0 {
+		return next, true
+	}
+	return 0, true
+}
+
+// verify records the result of the latest verification of the receiver by the Verified condition, and starts the
+// next verification in the background once it is due. A callback whose verification has been failing for longer than
+// its suspendAfter is suspended.
+func (r *CallbackUrlReconciler) verify(ctx context.Context, callback erinnerungv1alpha1.Callback, targetURL string, guard bool) error {
+	status := callback.CallbackStatus()
+	verification := callback.CallbackSpec().Verification
+	if verification == nil {
+		r.checks.result(callback.GetUID(), verificationCheck)
+		meta.RemoveStatusCondition(&status.Conditions, erinnerungv1alpha1.Verified)
+		status.LastVerificationTime = nil
+		status.VerifiedTarget = ""
+		return nil
+	}
+
+	// a new receiver, or a changed target, is not verified until it echoes a challenge
+	if status.VerifiedTarget != targetURL {
+		r.checks.stop(callback.GetUID(), verificationCheck)
+		setCondition(callback, erinnerungv1alpha1.Verified, metav1.ConditionUnknown, "Pending", "the receiver has not been verified yet")
+		status.LastVerificationTime = nil
+		status.VerifiedTime = nil
+		status.VerifiedTarget = targetURL
+	}
+
+	// the result of a check of an earlier target is dropped
+	if result, ok := r.checks.result(callback.GetUID(), verificationCheck); ok && result.target == targetURL {
+		if err := r.applyVerification(ctx, callback, result); err != nil {
+			return err
+		}
+	}
+	if next, _ := nextVerification(callback, time.Now()); next > 0 {
+		return nil
+	}
+
+	r.checks.start(ctx, callback, verificationCheck, verificationTimeout, func(ctx context.Context) checkResult {
+		result := checkResult{started: metav1.Now(), status: metav1.ConditionTrue, reason: "ChallengeEchoed", message: "the receiver echoed the challenge", target: targetURL}
+		if reason, err := r.sendChallenge(ctx, targetURL, guard); err != nil {
+			result.status, result.reason, result.message = metav1.ConditionFalse, reason, err.Error()
+		}
+		return result
+	})
+
+	return nil
+}
+
+// applyVerification records the result of a verification in the status of the callback, and suspends the callback if
+// its verification has been failing for longer than its suspendAfter.
+func (r *CallbackUrlReconciler) applyVerification(ctx context.Context, callback erinnerungv1alpha1.Callback, result checkResult) error {
+	status := callback.CallbackStatus()
+	status.LastVerificationTime = &result.started
+	setCondition(callback, erinnerungv1alpha1.Verified, result.status, result.reason, result.message)
+	if result.status == metav1.ConditionTrue {
+		status.VerifiedTime = &result.started
+		return nil
+	}
+
+	verification := callback.CallbackSpec().Verification
+	if verification.SuspendAfter == nil || callback.CallbackSpec().Suspend {
+		return nil
+	}
+	failing := time.Since(meta.FindStatusCondition(status.Conditions, erinnerungv1alpha1.Verified).LastTransitionTime.Time)
+	if failing < verification.SuspendAfter.Duration {
+		return nil
+	}
+	return r.suspend(ctx, callback, "VerificationFailed", fmt.Sprintf("the verification has been failing for more than %s, the deliveries are suspended: %s", verification.SuspendAfter.Duration, result.message))
+}
+
+// sendChallenge sends a new challenge to the receiver and checks it is echoed. It returns the reason of the Verified
+// condition if it is not.
+func (r *CallbackUrlReconciler) sendChallenge(ctx context.Context, targetURL string, guard bool) (string, error) {
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return "ChallengeFailed", fmt.Errorf("unable to create a challenge: %w", err)
+	}
+	challenge := hex.EncodeToString(token)
+
+	body, err := json.Marshal(challengeRequest{Type: challengeType, Challenge: challenge})
+	if err != nil {
+		return "ChallengeFailed", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, targetURL, bytes.NewReader(body))
+	if err != nil {
+		return "ChallengeFailed", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := r.guardedClient(verificationTimeout, guard).Do(req)
+	if err != nil {
+		return "Unreachable", fmt.Errorf("unable to send the challenge: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		// the response is not echoed, the challenge must not read in-cluster Services for the tenant
+		return "ChallengeRejected", fmt.Errorf("the receiver rejected the challenge")
+	}
+
+	echo, err := io.ReadAll(io.LimitReader(resp.Body, maxChallengeResponseLength))
+	if err != nil {
+		return "Unreachable", fmt.Errorf("unable to read the response to the challenge: %w", err)
+	}
+	if strings.TrimSpace(string(echo)) == challenge {
+		return "", nil
+	}
+	var response challengeRequest
+	if json.Unmarshal(echo, &response) == nil && response.Challenge == challenge {
+		return "", nil
+	}
+
+	return "ChallengeMismatch", fmt.Errorf("the receiver did not echo the challenge")
+}
@@ -21,6 +21,7 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"os"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
@@ -28,9 +29,11 @@ import (
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
@@ -83,6 +86,10 @@ func main() {
 			os.Exit(1)
 		}
 	}
+	if err = configureNamespaces(&options, &ctrlConfig); err != nil {
+		setupLog.Error(err, "unable to configure the namespaces to operate in")
+		os.Exit(1)
+	}
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), options)
 	if err != nil {
 		setupLog.Error(err, "unable to start manager")
@@ -96,20 +103,59 @@ func main() {
 		setupLog.Error(err, "unable to create controller", "controller", "CallbackPayload")
 		os.Exit(1)
 	}
-	if err = (&controllers.CallbackUrlReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
-	}).SetupWithManager(mgr); err != nil {
+	callbackUrlReconciler := controllers.CallbackUrlReconciler{
+		Client:          mgr.GetClient(),
+		Scheme:          mgr.GetScheme(),
+		APIReader:       mgr.GetAPIReader(),
+		Recorder:        mgr.GetEventRecorderFor("callbackurl-controller"),
+		EgressPolicy:    ctrlConfig.EgressPolicy,
+		CrossNamespace:  ctrlConfig.CrossNamespace,
+		Namespaced:      ctrlConfig.Namespaced(),
+		SenderNamespace: senderNamespace(),
+
+		MaxConcurrentReconciles: ctrlConfig.MaxConcurrentReconciles,
+		CorrelationKey:          ctrlConfig.CorrelationKey,
+		IdempotencyKeyHeader:    ctrlConfig.IdempotencyKeyHeader,
+		SenderTemplate:          ctrlConfig.SenderTemplate,
+		SenderNetworkPolicies:   ctrlConfig.SenderNetworkPolicies,
+	}
+	if ctrlConfig.PriorityAging != nil {
+		callbackUrlReconciler.PriorityAging = ctrlConfig.PriorityAging.Duration
+	}
+	if signing := ctrlConfig.Signing; signing != nil {
+		keyring, err := setupSigning(mgr, signing)
+		if err != nil {
+			setupLog.Error(err, "unable to set up the signing of the deliveries")
+			os.Exit(1)
+		}
+		callbackUrlReconciler.Keyring = keyring
+		callbackUrlReconciler.SigningFormat = signing.Format
+	}
+	if err = (&callbackUrlReconciler).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "CallbackUrl")
 		os.Exit(1)
 	}
+	// a RoleBinding can not grant access to the cluster-scoped ClusterCallbackUrls
+	if ctrlConfig.Namespaced() {
+		setupLog.Info("not reconciling ClusterCallbackUrls, the operator is restricted to namespaces")
+	} else if err = (&controllers.ClusterCallbackUrlReconciler{
+		CallbackUrlReconciler: callbackUrlReconciler,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "ClusterCallbackUrl")
+		os.Exit(1)
+	}
 	/* We'll just make sure to set `ENABLE_WEBHOOKS=false` when we run locally.
 	 */
 	if os.Getenv("ENABLE_WEBHOOKS") != "false" {
+		erinnerungv1alpha1.SetWebhookConfig(&ctrlConfig)
 		if err = (&erinnerungv1alpha1.CallbackUrl{}).SetupWebhookWithManager(mgr); err != nil {
 			setupLog.Error(err, "unable to create webhook", "webhook", "CallbackUrl")
 			os.Exit(1)
 		}
+		if err = (&erinnerungv1alpha1.ClusterCallbackUrl{}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "ClusterCallbackUrl")
+			os.Exit(1)
+		}
 	}
 	//+kubebuilder:scaffold:builder
 
@@ -128,3 +174,64 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+// configureNamespaces sets up the manager's cache to watch all namespaces, the configured list of namespaces or only
+// the namespace the operator is running in.
+func configureNamespaces(options *ctrl.Options, ctrlConfig *erinnerungv1alpha1.ErinnerungConfig) error {
+	switch {
+	case ctrlConfig.OwnNamespace && len(ctrlConfig.Namespaces) > 0:
+		return fmt.Errorf("ownNamespace and namespaces are mutually exclusive")
+	case ctrlConfig.OwnNamespace:
+		ns := os.Getenv("POD_NAMESPACE")
+		if ns == "" {
+			return fmt.Errorf("ownNamespace requires the POD_NAMESPACE environment variable to be set")
+		}
+		options.Namespace = ns
+		setupLog.Info("operating in own namespace", "namespace", ns)
+	case len(ctrlConfig.Namespaces) == 1:
+		options.Namespace = ctrlConfig.Namespaces[0]
+		setupLog.Info("operating in namespace", "namespace", options.Namespace)
+	case len(ctrlConfig.Namespaces) > 1:
+		options.NewCache = cache.MultiNamespacedCacheBuilder(ctrlConfig.Namespaces)
+		setupLog.Info("operating in namespaces", "namespaces", ctrlConfig.Namespaces)
+	default:
+		setupLog.Info("operating in all namespaces")
+	}
+
+	return nil
+}
+
+// setupSigning returns the Keyring signing the deliveries, and serves its public keys with a JWKSServer.
+func setupSigning(mgr ctrl.Manager, signing *erinnerungv1alpha1.SigningConfig) (*controllers.Keyring, error) {
+	if signing.SecretName == "" {
+		return nil, fmt.Errorf("signing requires a secretName")
+	}
+	namespace := signing.SecretNamespace
+	if namespace == "" {
+		namespace = senderNamespace()
+	}
+	keyring := &controllers.Keyring{
+		Reader: mgr.GetAPIReader(),
+		Secret: types.NamespacedName{Namespace: namespace, Name: signing.SecretName},
+	}
+
+	addr := signing.JWKSBindAddress
+	if addr == "" {
+		addr = ":8082"
+	}
+	if err := mgr.Add(&controllers.JWKSServer{Addr: addr, Keyring: keyring}); err != nil {
+		return nil, err
+	}
+	setupLog.Info("signing the deliveries", "secret", keyring.Secret, "jwks", addr)
+
+	return keyring, nil
+}
+
+// senderNamespace returns the namespace the sender Jobs of ClusterCallbackUrls are created in, which is the namespace
+// the operator is running in.
+func senderNamespace() string {
+	if ns := os.Getenv("POD_NAMESPACE"); ns != "" {
+		return ns
+	}
+	return "default"
+}